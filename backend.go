@@ -2,6 +2,7 @@ package smtp
 
 import (
 	"io"
+	"time"
 )
 
 var (
@@ -18,9 +19,36 @@ var (
 
 // A SMTP server backend.
 type Backend interface {
+	// NewSession is called when the client greets the server with HELO, EHLO
+	// or LHLO. If it returns an *SMTPError, its code and message are used as
+	// the reply: with a 421 or 554 code, the connection is closed right after.
+	// Other errors are reported with a 451 reply.
+	//
+	// To refuse a client entirely (e.g. a blocklisted IP) with a 554 greeting
+	// instead of the 220 banner, implement GreetingBackend.
 	NewSession(c ConnectionState, hostname string) (Session, error)
 }
 
+// GreetingBackend is an add-on interface for Backend. It can be implemented by
+// backends which refuse some clients entirely, e.g. blocklisted IPs.
+type GreetingBackend interface {
+	// CheckConnection is called for each new connection, before the greeting
+	// is sent, like Server.ConnectionChecker. If it returns an error, the
+	// greeting carries the error's code and message if it's an *SMTPError,
+	// and a 554 reply otherwise. The connection is then closed.
+	CheckConnection(c ConnectionState) error
+}
+
+// ConnBackend is an add-on interface for Backend. It can be implemented by
+// backends which need access to the connection, e.g. to call
+// Conn.ReceivedHeader.
+type ConnBackend interface {
+	// NewConnSession is called instead of NewSession when the client greets
+	// the server. The client's domain is available with
+	// Conn.State().Hostname.
+	NewConnSession(c *Conn) (Session, error)
+}
+
 type BodyType string
 
 const (
@@ -42,10 +70,16 @@ type MailOptions struct {
 	//
 	// The message should be rejected if it can't be transmitted
 	// with TLS.
+	//
+	// When sending, the connection must already use TLS and the server must
+	// support the REQUIRETLS extension.
 	RequireTLS bool
 
 	// The message envelope or message header contains UTF-8-encoded strings.
 	// This flag is set by SMTPUTF8-aware (RFC 6531) client.
+	//
+	// When sending, it allows non-ASCII characters in addresses. The server
+	// must support the SMTPUTF8 extension.
 	UTF8 bool
 
 	// The authorization identity asserted by the message sender in decoded
@@ -56,6 +90,86 @@ type MailOptions struct {
 	//
 	// Defined in RFC 4954.
 	Auth *string
+
+	// Value of RET= argument, FULL or HDRS.
+	//
+	// Defined in RFC 3461.
+	Ret DSNReturn
+
+	// Envelope identifier set by the client, in decoded form.
+	//
+	// Defined in RFC 3461.
+	EnvelopeID string
+
+	// Priority of the message, between -9 (lowest) and 9 (highest). Zero is
+	// the default priority.
+	//
+	// When sending, it's only sent if the server supports the MT-PRIORITY
+	// extension.
+	//
+	// Defined in RFC 6710.
+	Priority int
+
+	// Time within which the message should be delivered, with a resolution
+	// of one second. Zero means no deadline. DeliverByMode specifies what
+	// happens if the message can't be delivered in time.
+	//
+	// When sending, it's only sent if the server supports the DELIVERBY
+	// extension.
+	//
+	// Defined in RFC 2852.
+	DeliverBy time.Duration
+	// Value of the by-mode, DeliverByReturn if empty.
+	//
+	// Defined in RFC 2852.
+	DeliverByMode DeliverByMode
+}
+
+type DeliverByMode string
+
+const (
+	// The message is returned as undeliverable if it can't be delivered in
+	// time.
+	DeliverByReturn DeliverByMode = "R"
+	// A delay DSN is sent if the message can't be delivered in time.
+	DeliverByNotify DeliverByMode = "N"
+)
+
+type DSNReturn string
+
+const (
+	DSNReturnFull    DSNReturn = "FULL"
+	DSNReturnHeaders DSNReturn = "HDRS"
+)
+
+type DSNNotify string
+
+const (
+	DSNNotifyNever   DSNNotify = "NEVER"
+	DSNNotifySuccess DSNNotify = "SUCCESS"
+	DSNNotifyFailure DSNNotify = "FAILURE"
+	DSNNotifyDelay   DSNNotify = "DELAY"
+)
+
+// RcptOptions contains custom arguments that were
+// passed as an argument to the RCPT command.
+type RcptOptions struct {
+	// Value of NOTIFY= argument, NEVER or a combination of SUCCESS, FAILURE
+	// and DELAY.
+	//
+	// Defined in RFC 3461.
+	Notify []DSNNotify
+
+	// Original recipient address, in decoded form. It is sent with the
+	// "rfc822" address type.
+	//
+	// Defined in RFC 3461.
+	OrigRcpt string
+
+	// Number of recipients already accepted in the current transaction. This
+	// isn't a RCPT argument: it's set by the server so that backends can
+	// apply their own policy, and ignored when sending.
+	Count int
 }
 
 // Session is used by servers to respond to an SMTP client.
@@ -76,9 +190,83 @@ type Session interface {
 	// Add recipient for currently processed message.
 	Rcpt(to string) error
 	// Set currently processed message contents and send it.
+	//
+	// r streams the message from the connection as it's received, so it can
+	// be passed to a content scanner (e.g. with io.TeeReader) without
+	// buffering the whole message. Data may return before reaching the end
+	// of r: the rest of the message is then discarded by the server. If the
+	// returned error is, or wraps, an *SMTPError, it's used as the reply,
+	// e.g. to reject a message partway with "554 5.7.1 Rejected by content
+	// filter".
 	Data(r io.Reader) error
 }
 
+// RcptOptionsSession is an add-on interface for Session. It can be implemented
+// by backends to receive the arguments passed to the RCPT command, such as the
+// DSN parameters.
+type RcptOptionsSession interface {
+	// RcptWithOptions is called instead of Rcpt when the remote client
+	// issues a RCPT command.
+	RcptWithOptions(to string, opts *RcptOptions) error
+}
+
+// QueueIDSession is an add-on interface for Session. It can be implemented by
+// backends which assign an ID to accepted messages, so that it can be used by
+// the client to track them.
+type QueueIDSession interface {
+	// DataWithQueueID is called instead of Data. If the message is accepted
+	// and the returned ID isn't empty, it's included in the reply, e.g.
+	// "250 2.0.0 OK: queued as <id>". It isn't used with LMTP.
+	DataWithQueueID(r io.Reader) (queueID string, err error)
+}
+
+// VerifySession is an add-on interface for Session. It can be implemented by
+// backends which answer the VRFY command. Otherwise, the server replies that
+// it can't verify the address but will accept messages for it (252).
+type VerifySession interface {
+	// Verify checks whether addr is a valid mailbox. If it returns nil, the
+	// server confirms it with a 250 reply. An *SMTPError is used as the reply,
+	// e.g. 550 for an unknown mailbox.
+	Verify(addr string) error
+}
+
+// ExpandSession is an add-on interface for Session. It can be implemented by
+// backends which answer the EXPN command. Otherwise, the server replies that
+// it can't expand the list but will accept messages for it (252).
+type ExpandSession interface {
+	// Expand returns the addresses of the members of a mailing list. An
+	// *SMTPError is used as the reply, e.g. 550 for an unknown list.
+	Expand(list string) ([]string, error)
+}
+
+// MessageSizeSession is an add-on interface for Session. It can be
+// implemented by backends which enforce a per-session message size limit,
+// e.g. a larger one for authenticated users.
+type MessageSizeSession interface {
+	// MaxMessageBytes returns the maximum size of messages, in bytes, which
+	// replaces Server.MaxMessageBytes. Zero means no limit. It's called for
+	// each MAIL, DATA and BDAT command, so the limit may change once the
+	// client has authenticated.
+	//
+	// The SIZE advertised in the EHLO reply is still Server.MaxMessageBytes.
+	// If the limit is stricter, the SIZE parameter of MAIL is checked against
+	// it, so clients are told early. If it's looser, well-behaved clients
+	// won't send messages larger than the advertised SIZE.
+	MaxMessageBytes() int
+}
+
+// LogoutReasonSession is an add-on interface for Session. It can be
+// implemented by backends which need to know why a session ended.
+type LogoutReasonSession interface {
+	// LogoutWithReason is called instead of Logout when the session ends.
+	// reason is nil if the client quit cleanly with the QUIT command or if
+	// the session is restarted (e.g. after STARTTLS). Otherwise, it
+	// describes why the connection was closed: io.EOF if the client dropped
+	// the connection, a net.Error on timeout, or another error for protocol
+	// errors and server-initiated closes.
+	LogoutWithReason(reason error) error
+}
+
 // LMTPSession is an add-on interface for Session. It can be implemented by
 // LMTP servers to provide extra functionality.
 type LMTPSession interface {
@@ -23,6 +23,20 @@ func (be *TransformBackend) NewSession(c smtp.ConnectionState, hostname string)
 	return &transformSession{Session: sess, be: be}, nil
 }
 
+func (be *TransformBackend) NewConnSession(c *smtp.Conn) (smtp.Session, error) {
+	var sess smtp.Session
+	var err error
+	if cbe, ok := be.Backend.(smtp.ConnBackend); ok {
+		sess, err = cbe.NewConnSession(c)
+	} else {
+		sess, err = be.Backend.NewSession(c.State(), c.State().Hostname)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &transformSession{Session: sess, be: be}, nil
+}
+
 type transformSession struct {
 	Session smtp.Session
 
@@ -49,6 +63,10 @@ func (s *transformSession) Mail(from string, opts *smtp.MailOptions) error {
 }
 
 func (s *transformSession) Rcpt(to string) error {
+	return s.RcptWithOptions(to, &smtp.RcptOptions{})
+}
+
+func (s *transformSession) RcptWithOptions(to string, opts *smtp.RcptOptions) error {
 	if s.be.TransformRcpt != nil {
 		var err error
 		to, err = s.be.TransformRcpt(to)
@@ -56,20 +74,38 @@ func (s *transformSession) Rcpt(to string) error {
 			return err
 		}
 	}
+	if sess, ok := s.Session.(smtp.RcptOptionsSession); ok {
+		return sess.RcptWithOptions(to, opts)
+	}
 	return s.Session.Rcpt(to)
 }
 
 func (s *transformSession) Data(r io.Reader) error {
+	_, err := s.DataWithQueueID(r)
+	return err
+}
+
+func (s *transformSession) DataWithQueueID(r io.Reader) (string, error) {
 	if s.be.TransformData != nil {
 		var err error
 		r, err = s.be.TransformData(r)
 		if err != nil {
-			return err
+			return "", err
 		}
 	}
-	return s.Session.Data(r)
+	if sess, ok := s.Session.(smtp.QueueIDSession); ok {
+		return sess.DataWithQueueID(r)
+	}
+	return "", s.Session.Data(r)
 }
 
 func (s *transformSession) Logout() error {
 	return s.Session.Logout()
 }
+
+func (s *transformSession) LogoutWithReason(reason error) error {
+	if sess, ok := s.Session.(smtp.LogoutReasonSession); ok {
+		return sess.LogoutWithReason(reason)
+	}
+	return s.Session.Logout()
+}
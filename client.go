@@ -5,21 +5,30 @@
 package smtp
 
 import (
+	"bufio"
+	"context"
 	"crypto/tls"
 	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/textproto"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
 )
 
 // A Client represents a client connection to an SMTP server.
+//
+// Methods with a Context suffix abort the command when the context is done.
+// In this case the connection is left in an unknown state: it can't be used
+// to send further commands and should be closed.
 type Client struct {
 	// Text is the textproto.Conn used by the Client. It is exported to allow for
 	// clients to add extensions.
@@ -32,6 +41,7 @@ type Client struct {
 	tls        bool
 	serverName string
 	lmtp       bool
+	greeting   string // text of the server greeting
 	// map of supported extensions
 	ext map[string]string
 	// supported auth mechanisms
@@ -40,12 +50,65 @@ type Client struct {
 	didHello   bool     // whether we've said HELO/EHLO/LHLO
 	helloError error    // the error from the hello
 	rcpts      []string // recipients accumulated for the current session
+	binarymime bool     // whether the current transaction uses BODY=BINARYMIME
+	// whether MAIL was refused because authentication is required
+	authRequired bool
+	// mechanism used by the last successful AUTH
+	authMech string
+	// name of the last command sent, for UnexpectedCloseError
+	lastCmd string
+
+	// mu serializes commands, so that keep-alive NOOPs never interleave with
+	// other commands.
+	mu           sync.Mutex
+	lastActivity time.Time // time of the last command
+	inData       bool      // whether a message transfer is in progress
+
+	keepAliveMu   sync.Mutex
+	keepAliveStop chan struct{}
+	keepAliveDone chan struct{} // closed when the keep-alive goroutine exits
+
+	// deadlineMu protects interrupted and serializes deadline updates on
+	// conn, so that a cancelled context can't be overridden by a command
+	// timeout.
+	deadlineMu  sync.Mutex
+	interrupted bool
+	// err is a sticky error set once the connection is left in an unknown
+	// state, e.g. after a command was interrupted by its context.
+	err error
 
-	// Time to wait for command responses (this includes 3xx reply to DATA).
+	// Time to wait for each command exchange (this includes 3xx reply to
+	// DATA). While a message is written, the deadline is reset after each
+	// write. If zero, commands never time out.
 	CommandTimeout time.Duration
-	// Time to wait for responses after final dot.
+	// Time to wait for responses after final dot. If zero, the response is
+	// awaited indefinitely.
 	SubmissionTimeout time.Duration
 
+	// If true, Auth attempts SASL mechanisms even if the server doesn't
+	// advertise them. This can be used with servers whose EHLO response
+	// doesn't list all supported mechanisms.
+	AllowUnadvertisedAuth bool
+
+	// If true, a failed EHLO is returned as an error instead of falling back
+	// to HELO. This should be set by clients which rely on extensions such as
+	// STARTTLS or AUTH, since none are available after HELO.
+	RequireESMTP bool
+
+	// Maximum size of the chunks sent by BData. If zero, DefaultChunkSize
+	// is used.
+	ChunkSize int
+
+	// If true, the writer returned by Data rejects messages containing a
+	// bare LF or a lone CR instead of sending them. Otherwise, bare LFs are
+	// converted to CRLF and lone CRs are sent as is.
+	StrictCRLF bool
+	// If true, the writer returned by Data rejects messages with lines longer
+	// than 1000 octets, including the CRLF and the dot added by dot-stuffing,
+	// as required by RFC 5321 section 4.5.3.1.6. Otherwise, long lines are
+	// sent as is.
+	StrictLineLength bool
+
 	// Logger for all network activity.
 	DebugWriter io.Writer
 }
@@ -57,7 +120,22 @@ var defaultTimeout = 30 * time.Second
 // Dial returns a new Client connected to an SMTP server at addr.
 // The addr must include a port, as in "mail.example.com:smtp".
 func Dial(addr string) (*Client, error) {
-	conn, err := net.DialTimeout("tcp", addr, defaultTimeout)
+	return DialWithDialer(&net.Dialer{Timeout: defaultTimeout}, addr)
+}
+
+// ContextDialer dials network connections. It's implemented by net.Dialer and
+// by the SOCKS5 dialer from golang.org/x/net/proxy.
+type ContextDialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// DialWithDialer is like Dial, but uses dialer to connect to the SMTP server.
+// This can be used to route the connection through a proxy.
+func DialWithDialer(dialer ContextDialer, addr string) (*Client, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
 	if err != nil {
 		return nil, err
 	}
@@ -65,8 +143,38 @@ func Dial(addr string) (*Client, error) {
 	return NewClient(conn, host)
 }
 
-// DialTLS returns a new Client connected to an SMTP server via TLS at addr.
-// The addr must include a port, as in "mail.example.com:smtps".
+// happyEyeballsDelay is the delay before falling back to the other address
+// family, as recommended by RFC 8305 section 5.
+const happyEyeballsDelay = 250 * time.Millisecond
+
+// DialHappyEyeballs returns a new Client connected to an SMTP server at host
+// and port. If host resolves to both IPv6 and IPv4 addresses, connections to
+// both address families are raced as described in RFC 8305: the IPv4 attempt
+// starts if the IPv6 one hasn't succeeded within a short delay, and the first
+// established connection is used. This avoids stalling on hosts advertising
+// unreachable IPv6 addresses.
+//
+// ctx bounds the connection attempts, but not the returned Client.
+func DialHappyEyeballs(ctx context.Context, host, port string) (*Client, error) {
+	dialer := net.Dialer{
+		Timeout:       defaultTimeout,
+		FallbackDelay: happyEyeballsDelay,
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(host, port))
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn, host)
+}
+
+// DialTLS returns a new Client connected to an SMTP server via TLS at addr,
+// as used for implicit TLS submission (RFC 8314). The addr must include a
+// port, as in "mail.example.com:smtps".
+//
+// The TLS handshake is performed before the greeting is read, so all commands,
+// including EHLO, are sent over the encrypted connection. The server name used
+// when authenticating is tlsConfig.ServerName, or the host part of addr if
+// empty.
 //
 // A nil tlsConfig is equivalent to a zero tls.Config.
 func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
@@ -81,12 +189,30 @@ func DialTLS(addr string, tlsConfig *tls.Config) (*Client, error) {
 		return nil, err
 	}
 	host, _, _ := net.SplitHostPort(addr)
+	if tlsConfig != nil && tlsConfig.ServerName != "" {
+		host = tlsConfig.ServerName
+	}
 	return NewClient(conn, host)
 }
 
+// DefaultGreetingTimeout is the maximum duration NewClient waits for the
+// server greeting, as recommended by RFC 5321.
+const DefaultGreetingTimeout = 5 * time.Minute
+
 // NewClient returns a new Client using an existing connection and host as a
 // server name to be used when authenticating.
+//
+// The server greeting is awaited for at most DefaultGreetingTimeout.
 func NewClient(conn net.Conn, host string) (*Client, error) {
+	return NewClientWithGreetingTimeout(conn, host, DefaultGreetingTimeout)
+}
+
+// NewClientWithGreetingTimeout is like NewClient, but waits for the server
+// greeting for at most timeout. Servers which accept connections but never
+// send a greeting, such as tarpits, can then be given up on quickly. If the
+// timeout is exceeded, a *GreetingTimeoutError is returned. If zero, the
+// greeting is awaited indefinitely.
+func NewClientWithGreetingTimeout(conn net.Conn, host string, timeout time.Duration) (*Client, error) {
 	c := &Client{
 		serverName: host,
 		localName:  "localhost",
@@ -101,22 +227,47 @@ func NewClient(conn net.Conn, host string) (*Client, error) {
 
 	c.setConn(conn)
 
-	// Initial greeting timeout. RFC 5321 recommends 5 minutes.
-	c.conn.SetDeadline(time.Now().Add(5 * time.Minute))
-	defer c.conn.SetDeadline(time.Time{})
+	c.setTimeout(timeout)
+	defer c.setDeadline(time.Time{})
 
-	_, _, err := c.Text.ReadResponse(220)
+	_, msg, err := c.Text.ReadResponse(220)
 	if err != nil {
 		c.Text.Close()
 		if protoErr, ok := err.(*textproto.Error); ok {
-			return nil, toSMTPErr(protoErr)
+			return nil, c.checkClosed(toSMTPErr(protoErr))
 		}
-		return nil, err
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return nil, &GreetingTimeoutError{Timeout: timeout, Err: err}
+		}
+		return nil, c.wrapUnexpectedClose(err)
 	}
+	c.greeting = msg
 
 	return c, nil
 }
 
+// GreetingTimeoutError is returned by NewClient when the server doesn't send
+// its greeting in time. It matches ErrTimeout with errors.Is.
+type GreetingTimeoutError struct {
+	// The timeout which was exceeded.
+	Timeout time.Duration
+	// The underlying network error.
+	Err error
+}
+
+func (err *GreetingTimeoutError) Error() string {
+	return fmt.Sprintf("smtp: no greeting received within %v: %v", err.Timeout, err.Err)
+}
+
+func (err *GreetingTimeoutError) Unwrap() error {
+	return err.Err
+}
+
+func (err *GreetingTimeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
 // NewClientLMTP returns a new LMTP Client (as defined in RFC 2033) using an
 // existing connector and host as a server name to be used when authenticating.
 func NewClientLMTP(conn net.Conn, host string) (*Client, error) {
@@ -128,9 +279,29 @@ func NewClientLMTP(conn net.Conn, host string) (*Client, error) {
 	return c, nil
 }
 
+// DialLMTP returns a new LMTP Client connected to a server at address on the
+// named network, as accepted by net.Dial. LMTP servers usually listen on a
+// Unix domain socket, e.g. DialLMTP("unix", "/var/run/dovecot/lmtp").
+//
+// For Unix domain sockets, "localhost" is used as the server name.
+func DialLMTP(network, address string) (*Client, error) {
+	dialer := net.Dialer{Timeout: defaultTimeout}
+	conn, err := dialer.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	host := "localhost"
+	if !strings.HasPrefix(network, "unix") {
+		host, _, _ = net.SplitHostPort(address)
+	}
+	return NewClientLMTP(conn, host)
+}
+
 // setConn sets the underlying network connection for the client.
 func (c *Client) setConn(conn net.Conn) {
+	c.deadlineMu.Lock()
 	c.conn = conn
+	c.deadlineMu.Unlock()
 
 	var r io.Reader = conn
 	var w io.Writer = conn
@@ -159,17 +330,87 @@ func (c *Client) setConn(conn net.Conn) {
 	c.tls = isTLS
 }
 
+// Greeting returns the text of the greeting sent by the server when the
+// connection was opened, without the reply code. Lines of a multiline
+// greeting are separated by "\n".
+func (c *Client) Greeting() string {
+	return c.greeting
+}
+
 // Close closes the connection.
 func (c *Client) Close() error {
+	c.SetKeepAlive(0)
 	return c.Text.Close()
 }
 
+// SetKeepAlive makes the client send a NOOP command each time the connection
+// has been idle for the provided interval, to prevent the server from closing
+// it. Keep-alives are never sent while another command or a message transfer
+// is in progress.
+//
+// An interval of zero disables keep-alives. Keep-alives are stopped when the
+// connection is closed.
+func (c *Client) SetKeepAlive(interval time.Duration) {
+	c.keepAliveMu.Lock()
+	defer c.keepAliveMu.Unlock()
+
+	if c.keepAliveStop != nil {
+		// Wait for a NOOP in flight, so that it doesn't race with Close
+		close(c.keepAliveStop)
+		<-c.keepAliveDone
+		c.keepAliveStop = nil
+		c.keepAliveDone = nil
+	}
+	if interval <= 0 {
+		return
+	}
+	c.keepAliveStop = make(chan struct{})
+	c.keepAliveDone = make(chan struct{})
+	go c.keepAlive(interval, c.keepAliveStop, c.keepAliveDone)
+}
+
+func (c *Client) keepAlive(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		c.mu.Lock()
+		var err error
+		select {
+		case <-stop:
+			c.mu.Unlock()
+			return
+		default:
+			if c.didHello && !c.inData && c.err == nil && time.Since(c.lastActivity) >= interval {
+				_, _, err = c.cmd(250, "NOOP")
+				c.lastActivity = time.Now()
+			}
+		}
+		c.mu.Unlock()
+
+		if _, ok := err.(*SMTPError); err != nil && !ok {
+			// The connection is broken, the next command will report it
+			return
+		}
+	}
+}
+
 // hello runs a hello exchange if needed.
 func (c *Client) hello() error {
 	if !c.didHello {
 		c.didHello = true
 		err := c.ehlo()
-		if err != nil {
+		if err != nil && c.RequireESMTP {
+			c.helloError = err
+		} else if err != nil {
 			c.helloError = c.helo()
 		}
 	}
@@ -184,6 +425,11 @@ func (c *Client) hello() error {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Hello(localName string) error {
+	return c.HelloContext(context.Background(), localName)
+}
+
+// HelloContext is like Hello, but aborts the exchange when ctx is done.
+func (c *Client) HelloContext(ctx context.Context, localName string) error {
 	if err := validateLine(localName); err != nil {
 		return err
 	}
@@ -191,32 +437,309 @@ func (c *Client) Hello(localName string) error {
 		return errors.New("smtp: Hello called after other methods")
 	}
 	c.localName = localName
-	return c.hello()
+	return c.withContext(ctx, c.hello)
+}
+
+// SetLocalName sets the host name used to introduce the client in the
+// HELO/EHLO command, without sending it. It must be a domain name or an
+// address literal such as "[192.0.2.1]" or "[IPv6:2001:db8::1]". It must be
+// called before any of the other methods.
+//
+// Many servers reject or penalize clients introducing themselves as
+// "localhost", the default.
+func (c *Client) SetLocalName(name string) error {
+	if err := validateLine(name); err != nil {
+		return err
+	}
+	if !isDomain(name) && !isAddressLiteral(name) {
+		return fmt.Errorf("smtp: invalid local name %q", name)
+	}
+	if c.didHello {
+		return errors.New("smtp: SetLocalName called after other methods")
+	}
+	c.localName = name
+	return nil
+}
+
+// SetLocalNameFromOS sets the host name used to introduce the client to the
+// host name reported by the operating system, if it's a fully-qualified
+// domain name. Otherwise, the address literal of the local end of the
+// connection is used.
+func (c *Client) SetLocalNameFromOS() error {
+	if hostname, err := os.Hostname(); err == nil && strings.Contains(hostname, ".") && isDomain(hostname) {
+		return c.SetLocalName(hostname)
+	}
+
+	addr, ok := c.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		return errors.New("smtp: host name isn't fully qualified and connection has no local IP address")
+	}
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		return c.SetLocalName("[" + ip4.String() + "]")
+	}
+	return c.SetLocalName("[IPv6:" + addr.IP.String() + "]")
+}
+
+// isDomain checks whether s is a domain, as defined in RFC 5321 section
+// 4.1.2.
+func isDomain(s string) bool {
+	if s == "" || len(s) > 255 {
+		return false
+	}
+	for _, label := range strings.Split(s, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, ch := range label {
+			if !(ch >= 'a' && ch <= 'z') && !(ch >= 'A' && ch <= 'Z') && !(ch >= '0' && ch <= '9') && ch != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isAddressLiteral checks whether s is an IPv4 or IPv6 address literal, as
+// defined in RFC 5321 section 4.1.3.
+func isAddressLiteral(s string) bool {
+	if !strings.HasPrefix(s, "[") || !strings.HasSuffix(s, "]") {
+		return false
+	}
+	s = s[1 : len(s)-1]
+	if strings.HasPrefix(s, "IPv6:") {
+		return net.ParseIP(strings.TrimPrefix(s, "IPv6:")) != nil
+	}
+	return net.ParseIP(s) != nil && !strings.Contains(s, ":")
+}
+
+// aLongTimeAgo is a non-zero time, far in the past, used to interrupt
+// pending I/O on the connection.
+var aLongTimeAgo = time.Unix(1, 0)
+
+// setDeadline sets the read and write deadlines of the underlying connection,
+// unless the connection has been interrupted.
+func (c *Client) setDeadline(t time.Time) {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	if c.interrupted {
+		return
+	}
+	c.conn.SetDeadline(t)
+}
+
+// setTimeout sets the deadlines of the underlying connection to d from now.
+// A zero duration clears the deadlines.
+func (c *Client) setTimeout(d time.Duration) {
+	if d == 0 {
+		c.setDeadline(time.Time{})
+	} else {
+		c.setDeadline(time.Now().Add(d))
+	}
+}
+
+// ErrTimeout is matched by errors.Is for errors returned when a command
+// exceeds CommandTimeout or SubmissionTimeout. The underlying network error
+// is wrapped and can be retrieved with errors.As.
+var ErrTimeout = errors.New("smtp: command timed out")
+
+type timeoutError struct {
+	err error
+}
+
+func (err *timeoutError) Error() string {
+	return fmt.Sprintf("%v: %v", ErrTimeout, err.err)
+}
+
+func (err *timeoutError) Unwrap() error {
+	return err.err
+}
+
+func (err *timeoutError) Is(target error) bool {
+	return target == ErrTimeout
+}
+
+// wrapTimeout wraps err into a *timeoutError if it's a network timeout.
+func wrapTimeout(err error) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return &timeoutError{err}
+	}
+	return err
+}
+
+// interrupt unblocks any pending I/O on the connection and prevents further
+// deadline updates.
+func (c *Client) interrupt() {
+	c.deadlineMu.Lock()
+	defer c.deadlineMu.Unlock()
+	c.interrupted = true
+	c.conn.SetDeadline(aLongTimeAgo)
+}
+
+// withContext runs f and interrupts it when ctx is done.
+//
+// Once f has been interrupted, the connection is in an unknown state (e.g. a
+// reply may have been partially read), so it is marked as unusable and all
+// subsequent commands fail.
+func (c *Client) withContext(ctx context.Context, f func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	defer func() {
+		c.lastActivity = time.Now()
+	}()
+
+	if c.err != nil {
+		return c.err
+	}
+	if ctx.Done() == nil {
+		return wrapTimeout(f())
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			c.interrupt()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	err := f()
+	close(stop)
+	if <-interrupted {
+		err = ctx.Err()
+		c.err = fmt.Errorf("smtp: connection unusable after interrupted command: %w", err)
+		return err
+	}
+	return wrapTimeout(err)
 }
 
 // cmd is a convenience function that sends a command and returns the response
 // textproto.Error returned by c.Text.ReadResponse is converted into SMTPError.
 func (c *Client) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
-	c.conn.SetDeadline(time.Now().Add(c.CommandTimeout))
-	defer c.conn.SetDeadline(time.Time{})
+	if c.err != nil {
+		return 0, "", c.err
+	}
 
-	id, err := c.Text.Cmd(format, args...)
+	c.setTimeout(c.CommandTimeout)
+	defer c.setDeadline(time.Time{})
+
+	line := fmt.Sprintf(format, args...)
+	if name := commandName(line); name != "" {
+		c.lastCmd = name
+	}
+
+	id, err := c.Text.Cmd("%s", line)
 	if err != nil {
 		return 0, "", err
 	}
 	c.Text.StartResponse(id)
 	defer c.Text.EndResponse(id)
+	return c.readResponse(expectCode)
+}
+
+// readResponse reads a single reply from the server. textproto.Error returned
+// by c.Text.ReadResponse is converted into SMTPError.
+func (c *Client) readResponse(expectCode int) (int, string, error) {
 	code, msg, err := c.Text.ReadResponse(expectCode)
 	if err != nil {
 		if protoErr, ok := err.(*textproto.Error); ok {
 			smtpErr := toSMTPErr(protoErr)
-			return code, smtpErr.Message, smtpErr
+			return code, smtpErr.Message, c.checkClosed(smtpErr)
 		}
-		return code, msg, err
+		return code, msg, c.wrapUnexpectedClose(err)
 	}
 	return code, msg, nil
 }
 
+// UnexpectedCloseError is returned when the server closes the connection
+// without replying to a command, or in the middle of a reply.
+type UnexpectedCloseError struct {
+	// Name of the last command sent, without its arguments, e.g. "RCPT TO".
+	// Empty if the connection was closed before the greeting.
+	Command string
+	// io.EOF or io.ErrUnexpectedEOF.
+	Err error
+}
+
+func (err *UnexpectedCloseError) Error() string {
+	if err.Command == "" {
+		return "smtp: unexpected connection close before the greeting: " + err.Err.Error()
+	}
+	return fmt.Sprintf("smtp: unexpected connection close after %v: %v", err.Command, err.Err)
+}
+
+func (err *UnexpectedCloseError) Unwrap() error {
+	return err.Err
+}
+
+func (c *Client) wrapUnexpectedClose(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &UnexpectedCloseError{Command: c.lastCmd, Err: err}
+	}
+	return err
+}
+
+// commandNames lists the commands sent by the client.
+var commandNames = map[string]bool{
+	"HELO": true, "EHLO": true, "LHLO": true, "STARTTLS": true,
+	"AUTH": true, "MAIL": true, "RCPT": true, "DATA": true, "BDAT": true,
+	"RSET": true, "VRFY": true, "EXPN": true, "HELP": true, "NOOP": true,
+	"QUIT": true, "XCLIENT": true,
+}
+
+// commandName returns the name of the command sent in line, e.g. "RCPT TO".
+// Arguments, which may contain credentials, are never included. An empty
+// string is returned for lines which aren't commands, such as AUTH responses.
+func commandName(line string) string {
+	name := line
+	if i := strings.IndexAny(line, " :"); i >= 0 {
+		name = line[:i]
+	}
+	name = strings.ToUpper(name)
+	switch {
+	case name == "MAIL":
+		return "MAIL FROM"
+	case name == "RCPT":
+		return "RCPT TO"
+	case commandNames[name]:
+		return name
+	default:
+		return ""
+	}
+}
+
+// ConnectionClosedError is returned when the server closes the connection with
+// a 421 reply (RFC 5321 section 3.8). It can be sent in reply to any command.
+// Once it has been received, the Client is unusable and all methods return
+// the same error, except Quit which only closes the connection.
+type ConnectionClosedError struct {
+	Reply *SMTPError
+}
+
+func (err *ConnectionClosedError) Error() string {
+	return "smtp: connection closed by the server: " + err.Reply.Error()
+}
+
+func (err *ConnectionClosedError) Unwrap() error {
+	return err.Reply
+}
+
+// checkClosed marks the client as unusable if smtpErr is a 421 reply.
+func (c *Client) checkClosed(smtpErr *SMTPError) error {
+	if smtpErr.Code != 421 {
+		return smtpErr
+	}
+	c.err = &ConnectionClosedError{Reply: smtpErr}
+	return c.err
+}
+
 // helo sends the HELO greeting to the server. It should be used only when the
 // server does not support ehlo.
 func (c *Client) helo() error {
@@ -243,16 +766,15 @@ func (c *Client) ehlo() error {
 		extList = extList[1:]
 		for _, line := range extList {
 			args := strings.SplitN(line, " ", 2)
+			name := strings.ToUpper(args[0])
 			if len(args) > 1 {
-				ext[args[0]] = args[1]
+				ext[name] = args[1]
 			} else {
-				ext[args[0]] = ""
+				ext[name] = ""
 			}
 		}
 	}
-	if mechs, ok := ext["AUTH"]; ok {
-		c.auth = strings.Split(mechs, " ")
-	}
+	c.auth = strings.Fields(ext["AUTH"])
 	c.ext = ext
 	return err
 }
@@ -260,10 +782,53 @@ func (c *Client) ehlo() error {
 // StartTLS sends the STARTTLS command and encrypts all further communication.
 // Only servers that advertise the STARTTLS extension support this function.
 //
-// A nil config is equivalent to a zero tls.Config.
+// A nil config is equivalent to a zero tls.Config. The server certificate can
+// be verified with a custom callback via config.VerifyConnection, e.g. to
+// authenticate the server with DANE (see DANEConfig).
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) StartTLS(config *tls.Config) error {
+	return c.StartTLSContext(context.Background(), config)
+}
+
+// StartTLSContext is like StartTLS, but aborts the negotiation when ctx is
+// done.
+func (c *Client) StartTLSContext(ctx context.Context, config *tls.Config) error {
+	return c.withContext(ctx, func() error {
+		return c.startTLS(config)
+	})
+}
+
+// StartTLSOpportunistic is like StartTLS, but falls back to cleartext if the
+// server doesn't advertise the STARTTLS extension or temporarily refuses to
+// start TLS (454 or 502 reply). It reports whether TLS has been negotiated,
+// so that the caller can decide whether to proceed with e.g. authentication.
+func (c *Client) StartTLSOpportunistic(config *tls.Config) (bool, error) {
+	return c.StartTLSOpportunisticContext(context.Background(), config)
+}
+
+// StartTLSOpportunisticContext is like StartTLSOpportunistic, but aborts the
+// negotiation when ctx is done.
+func (c *Client) StartTLSOpportunisticContext(ctx context.Context, config *tls.Config) (bool, error) {
+	err := c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if _, ok := c.ext["STARTTLS"]; !ok {
+			return nil
+		}
+		return c.startTLS(config)
+	})
+	if smtpErr, ok := err.(*SMTPError); ok && (smtpErr.Code == 454 || smtpErr.Code == 502) {
+		// The connection is still usable in cleartext
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return c.tls, nil
+}
+
+func (c *Client) startTLS(config *tls.Config) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
@@ -271,6 +836,13 @@ func (c *Client) StartTLS(config *tls.Config) error {
 	if err != nil {
 		return err
 	}
+	// The server must wait for the TLS handshake before sending anything
+	// else: buffered cleartext could have been injected by an attacker
+	// (CVE-2011-0411) and must not be mistaken for encrypted replies.
+	if c.Text.R.Buffered() > 0 {
+		c.err = errors.New("smtp: server sent unexpected data after STARTTLS reply")
+		return c.err
+	}
 	if config == nil {
 		config = &tls.Config{}
 	}
@@ -297,6 +869,16 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	return tc.ConnectionState(), true
 }
 
+// RemoteAddr returns the address of the server.
+func (c *Client) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// LocalAddr returns the local address of the connection to the server.
+func (c *Client) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
 // Verify checks the validity of an email address on the server.
 // If Verify returns nil, the address is valid. A non-nil return
 // does not necessarily indicate an invalid address. Many servers
@@ -304,21 +886,165 @@ func (c *Client) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Verify(addr string) error {
-	if err := validateLine(addr); err != nil {
+	return c.VerifyContext(context.Background(), addr)
+}
+
+// VerifyContext is like Verify, but aborts the command when ctx is done.
+func (c *Client) VerifyContext(ctx context.Context, addr string) error {
+	if err := ValidateAddress(addr); err != nil {
 		return err
 	}
-	if err := c.hello(); err != nil {
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		_, _, err := c.cmd(250, "VRFY %s", addr)
+		return err
+	})
+}
+
+// SizeExceededError is returned by Mail when the message size declared in
+// MailOptions exceeds the maximum message size advertised by the server. In
+// this case, the MAIL command is not sent.
+type SizeExceededError struct {
+	// Declared message size, in bytes.
+	Size int
+	// Maximum message size advertised by the server, in bytes.
+	MaxSize int
+}
+
+func (err *SizeExceededError) Error() string {
+	return fmt.Sprintf("smtp: message size (%v bytes) exceeds the server limit (%v bytes)", err.Size, err.MaxSize)
+}
+
+// ExpnError is returned by Expn when the server refuses to expand a mailing
+// list.
+type ExpnError struct {
+	*SMTPError
+
+	// Disabled is true if the server does not allow expanding mailing lists
+	// (252 reply). Otherwise the list does not exist (550 reply).
+	Disabled bool
+}
+
+func (err *ExpnError) Unwrap() error {
+	return err.SMTPError
+}
+
+// Expn asks the server to expand a mailing list and returns the addresses of
+// its members.
+//
+// If the server does not allow expansion or the list does not exist, the
+// returned error will be of type *ExpnError. Other server errors will be of
+// type *SMTPError.
+func (c *Client) Expn(list string) ([]string, error) {
+	return c.ExpnContext(context.Background(), list)
+}
+
+// ExpnContext is like Expn, but aborts the command when ctx is done.
+func (c *Client) ExpnContext(ctx context.Context, list string) ([]string, error) {
+	if err := validateLine(list); err != nil {
+		return nil, err
+	}
+	var msg string
+	err := c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		var err error
+		_, msg, err = c.cmd(250, "EXPN %s", list)
 		return err
+	})
+	if smtpErr, ok := err.(*SMTPError); ok && (smtpErr.Code == 252 || smtpErr.Code == 550) {
+		return nil, &ExpnError{SMTPError: smtpErr, Disabled: smtpErr.Code == 252}
+	} else if err != nil {
+		return nil, err
 	}
-	_, _, err := c.cmd(250, "VRFY %s", addr)
-	return err
+
+	var addrs []string
+	for _, line := range strings.Split(msg, "\n") {
+		line = trimEnhancedCode(line)
+		if i := strings.IndexByte(line, '<'); i >= 0 {
+			if j := strings.IndexByte(line[i:], '>'); j >= 0 {
+				line = line[i+1 : i+j]
+			}
+		}
+		if line = strings.TrimSpace(line); line != "" {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, nil
+}
+
+// HelpUnavailableError is returned by Help when the server does not
+// implement the HELP command (502 reply).
+type HelpUnavailableError struct {
+	*SMTPError
+}
+
+func (err *HelpUnavailableError) Unwrap() error {
+	return err.SMTPError
+}
+
+// Help sends the HELP command to the server and returns its reply text. If
+// topic is not empty, help about this specific topic is requested.
+//
+// If the server does not implement HELP, the returned error will be of type
+// *HelpUnavailableError and the connection can still be used. Other server
+// errors will be of type *SMTPError.
+func (c *Client) Help(topic string) (string, error) {
+	return c.HelpContext(context.Background(), topic)
+}
+
+// HelpContext is like Help, but aborts the command when ctx is done.
+func (c *Client) HelpContext(ctx context.Context, topic string) (string, error) {
+	if err := validateLine(topic); err != nil {
+		return "", err
+	}
+	var msg string
+	err := c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		var err error
+		if topic == "" {
+			_, msg, err = c.cmd(21, "HELP")
+		} else {
+			_, msg, err = c.cmd(21, "HELP %s", topic)
+		}
+		return err
+	})
+	if smtpErr, ok := err.(*SMTPError); ok && smtpErr.Code == 502 {
+		return "", &HelpUnavailableError{smtpErr}
+	} else if err != nil {
+		return "", err
+	}
+
+	lines := strings.Split(msg, "\n")
+	for i, line := range lines {
+		lines[i] = trimEnhancedCode(line)
+	}
+	return strings.Join(lines, "\n"), nil
 }
 
 // Auth authenticates a client using the provided authentication mechanism.
-// Only servers that advertise the AUTH extension support this function.
+// Only servers that advertise the AUTH extension support this function. The
+// mechanism must be advertised by the server, unless AllowUnadvertisedAuth is
+// set.
 //
 // If server returns an error, it will be of type *SMTPError.
 func (c *Client) Auth(a sasl.Client) error {
+	return c.AuthContext(context.Background(), a)
+}
+
+// AuthContext is like Auth, but aborts the exchange when ctx is done.
+func (c *Client) AuthContext(ctx context.Context, a sasl.Client) error {
+	return c.withContext(ctx, func() error {
+		return c.authenticate(a)
+	})
+}
+
+func (c *Client) authenticate(a sasl.Client) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
@@ -327,78 +1053,387 @@ func (c *Client) Auth(a sasl.Client) error {
 	if err != nil {
 		return err
 	}
-	resp64 := make([]byte, encoding.EncodedLen(len(resp)))
-	encoding.Encode(resp64, resp)
-	code, msg64, err := c.cmd(0, strings.TrimSpace(fmt.Sprintf("AUTH %s %s", mech, resp64)))
+	if !c.AllowUnadvertisedAuth && !c.supportsAuth(mech) {
+		return fmt.Errorf("smtp: server doesn't support AUTH mechanism %v", mech)
+	}
+	// A nil initial response is omitted, so that the server sends an empty
+	// challenge first. An empty one is sent as "=" (RFC 4954 section 4).
+	cmd := "AUTH " + mech
+	if resp != nil {
+		if len(resp) == 0 {
+			cmd += " ="
+		} else {
+			cmd += " " + encoding.EncodeToString(resp)
+		}
+	}
+	code, msg64, err := c.cmd(0, "%s", cmd)
 	for err == nil {
 		var msg []byte
 		switch code {
+		case 235:
+			if v, ok := a.(mutualAuthClient); ok {
+				if err := v.serverVerified(); err != nil {
+					return err
+				}
+			}
+			c.authRequired = false
+			c.authMech = mech
+			return nil
 		case 334:
 			msg, err = encoding.DecodeString(msg64)
-		case 235:
-			// the last message isn't base64 because it isn't a challenge
-			msg = []byte(msg64)
 		default:
-			err = toSMTPErr(&textproto.Error{Code: code, Msg: msg64})
+			// The exchange is over, "*" is only a valid reply to a 334
+			// challenge (RFC 4954 section 4)
+			return c.checkClosed(toSMTPErr(&textproto.Error{Code: code, Msg: msg64}))
 		}
 		if err == nil {
-			if code == 334 {
-				resp, err = a.Next(msg)
-			} else {
-				resp = nil
-			}
+			resp, err = a.Next(msg)
 		}
 		if err != nil {
 			// abort the AUTH
 			c.cmd(501, "*")
 			break
 		}
-		if resp == nil {
-			break
-		}
-		resp64 = make([]byte, encoding.EncodedLen(len(resp)))
-		encoding.Encode(resp64, resp)
-		code, msg64, err = c.cmd(0, string(resp64))
+		// A response is always expected after a challenge, even if empty
+		code, msg64, err = c.cmd(0, "%s", encoding.EncodeToString(resp))
 	}
 	return err
 }
 
-// Mail issues a MAIL command to the server using the provided email address.
-// If the server supports the 8BITMIME extension, Mail adds the BODY=8BITMIME
-// parameter.
-// This initiates a mail transaction and is followed by one or more Rcpt calls.
-//
-// If opts is not nil, MAIL arguments provided in the structure will be added
-// to the command. Handling of unsupported options depends on the extension.
+// autoAuthMechanisms lists the mechanisms used by AuthAuto, by order of
+// preference.
+var autoAuthMechanisms = []struct {
+	name      string
+	cleartext bool // whether the password is sent in cleartext
+	new       func(username, password string) sasl.Client
+}{
+	{"SCRAM-SHA-256", false, newScramSHA256Client},
+	{"CRAM-MD5", false, newCramMD5Client},
+	{sasl.Plain, true, func(username, password string) sasl.Client {
+		return sasl.NewPlainClient("", username, password)
+	}},
+	{sasl.Login, true, sasl.NewLoginClient},
+}
+
+// AuthAuto authenticates a client with a username and a password, using the
+// most secure mechanism supported by the server among SCRAM-SHA-256, CRAM-MD5,
+// PLAIN and LOGIN. PLAIN and LOGIN send the password in cleartext, so they are
+// only used over TLS.
 //
-// If server returns an error, it will be of type *SMTPError.
-func (c *Client) Mail(from string, opts *MailOptions) error {
-	if err := validateLine(from); err != nil {
-		return err
-	}
+// If the server rejects a mechanism, the next one is attempted. If all of
+// them fail, the returned error lists the attempted mechanisms.
+func (c *Client) AuthAuto(username, password string) error {
+	return c.AuthAutoContext(context.Background(), username, password)
+}
+
+// AuthAutoContext is like AuthAuto, but aborts the exchange when ctx is done.
+func (c *Client) AuthAutoContext(ctx context.Context, username, password string) error {
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if _, ok := c.ext["AUTH"]; !ok {
+			return errors.New("smtp: server doesn't support AUTH")
+		}
+
+		var failures []string
+		for _, mech := range autoAuthMechanisms {
+			if !c.supportsAuth(mech.name) || (mech.cleartext && !c.tls) {
+				continue
+			}
+			err := c.authenticate(mech.new(username, password))
+			if err == nil {
+				return nil
+			}
+			if _, ok := err.(*SMTPError); !ok {
+				return err
+			}
+			failures = append(failures, mech.name+": "+err.Error())
+		}
+		if len(failures) == 0 {
+			return fmt.Errorf("smtp: no suitable AUTH mechanism (server supports %v)", strings.Join(c.auth, " "))
+		}
+		return fmt.Errorf("smtp: authentication failed (%v)", strings.Join(failures, "; "))
+	})
+}
+
+// AuthCRAMMD5 authenticates a client with a username and a shared secret,
+// using the CRAM-MD5 mechanism (RFC 2195). The server must advertise it.
+//
+// Unlike PLAIN and LOGIN, CRAM-MD5 is a challenge-response mechanism which
+// never sends the secret itself, so it can be used over a cleartext
+// connection. It's still vulnerable to dictionary attacks by eavesdroppers:
+// prefer SCRAM-SHA-256 or TLS when available.
+func (c *Client) AuthCRAMMD5(username, secret string) error {
+	return c.AuthCRAMMD5Context(context.Background(), username, secret)
+}
+
+// AuthCRAMMD5Context is like AuthCRAMMD5, but aborts the exchange when ctx is
+// done.
+func (c *Client) AuthCRAMMD5Context(ctx context.Context, username, secret string) error {
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if !c.supportsAuth("CRAM-MD5") {
+			return errors.New("smtp: server doesn't support CRAM-MD5")
+		}
+		return c.authenticate(newCramMD5Client(username, secret))
+	})
+}
+
+// AuthXOAuth2 authenticates a client with an OAuth 2.0 access token, using the
+// XOAUTH2 mechanism supported by Gmail and Office 365.
+//
+// If the server rejects the token, the returned error will be of type
+// *XOAuth2Error and includes the details sent by the server.
+func (c *Client) AuthXOAuth2(username, token string) error {
+	return c.AuthXOAuth2Context(context.Background(), username, token)
+}
+
+// AuthXOAuth2Context is like AuthXOAuth2, but aborts the exchange when ctx is
+// done.
+func (c *Client) AuthXOAuth2Context(ctx context.Context, username, token string) error {
+	return c.withContext(ctx, func() error {
+		a := &xoauth2Client{username: username, token: token}
+		err := c.authenticate(a)
+		if smtpErr, ok := err.(*SMTPError); ok {
+			return newXOAuth2Error(smtpErr, a.details)
+		}
+		return err
+	})
+}
+
+// supportsAuth checks whether the server advertises the provided SASL
+// mechanism.
+func (c *Client) supportsAuth(mech string) bool {
+	for _, m := range c.auth {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// Mail issues a MAIL command to the server using the provided email address.
+// The BODY parameter depends on opts.Body:
+//
+//   - If empty and the server supports the 8BITMIME extension, BODY=8BITMIME
+//     is added, so that messages with 8-bit octets can always be sent. This
+//     is harmless for 7-bit messages, but a few legacy servers mishandle it:
+//     DetectBody can be used to pick Body7Bit instead.
+//   - If Body7Bit, BODY=7BIT is added if the server supports 8BITMIME.
+//   - If Body8BitMIME, BODY=8BITMIME is added: the server must support the
+//     8BITMIME extension.
+//   - If BodyBinaryMIME, BODY=BINARYMIME is added: the server must support
+//     the BINARYMIME extension and the message must be sent with BData.
+//
+// This initiates a mail transaction and is followed by one or more Rcpt calls.
+//
+// If opts is not nil, MAIL arguments provided in the structure will be added
+// to the command. Handling of unsupported options depends on the extension.
+//
+// If server returns an error, it will be of type *SMTPError, or
+// *AuthRequiredError if the client needs to authenticate first.
+func (c *Client) Mail(from string, opts *MailOptions) error {
+	return c.MailContext(context.Background(), from, opts)
+}
+
+// MailContext is like Mail, but aborts the command when ctx is done.
+func (c *Client) MailContext(ctx context.Context, from string, opts *MailOptions) error {
+	if err := ValidateAddress(from); err != nil {
+		return err
+	}
+	return c.withContext(ctx, func() error {
+		return c.mail(from, opts)
+	})
+}
+
+func (c *Client) mail(from string, opts *MailOptions) error {
 	if err := c.hello(); err != nil {
 		return err
 	}
-	cmdStr := "MAIL FROM:<%s>"
-	if _, ok := c.ext["8BITMIME"]; ok {
+	cmdStr, err := c.mailCmd(from, opts)
+	if err != nil {
+		return err
+	}
+	if _, _, err := c.cmd(250, "%s", cmdStr); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok && c.isAuthRequired(smtpErr) {
+			c.authRequired = true
+			return &AuthRequiredError{smtpErr}
+		}
+		return err
+	}
+	c.rcpts = nil
+	c.binarymime = opts != nil && opts.Body == BodyBinaryMIME
+	return nil
+}
+
+// AuthRequiredError is returned by Mail when the server refuses the MAIL
+// command because the client needs to authenticate first (530 reply, see RFC
+// 4954 section 6, or 5.7.0 enhanced code from a server advertising AUTH).
+type AuthRequiredError struct {
+	*SMTPError
+}
+
+func (err *AuthRequiredError) Unwrap() error {
+	return err.SMTPError
+}
+
+func (c *Client) isAuthRequired(smtpErr *SMTPError) bool {
+	if smtpErr.Code == 530 {
+		return true
+	}
+	return smtpErr.Code/100 == 5 && smtpErr.EnhancedCode == EnhancedCode{5, 7, 0} && len(c.auth) > 0
+}
+
+// AuthRequired reports whether the server requires authentication before
+// accepting mail. EHLO capabilities don't tell whether AUTH is mandatory, so
+// this is learned from the server's replies: AuthRequired returns true once
+// Mail has failed with an *AuthRequiredError, until authentication succeeds.
+func (c *Client) AuthRequired() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.authRequired
+}
+
+// MailWithAuthRetry is like Mail, but if the server requires authentication,
+// it authenticates with a and issues the MAIL command again.
+func (c *Client) MailWithAuthRetry(from string, opts *MailOptions, a sasl.Client) error {
+	return c.MailWithAuthRetryContext(context.Background(), from, opts, a)
+}
+
+// MailWithAuthRetryContext is like MailWithAuthRetry, but aborts the commands
+// when ctx is done.
+func (c *Client) MailWithAuthRetryContext(ctx context.Context, from string, opts *MailOptions, a sasl.Client) error {
+	err := c.MailContext(ctx, from, opts)
+	if _, ok := err.(*AuthRequiredError); !ok {
+		return err
+	}
+	if err := c.AuthContext(ctx, a); err != nil {
+		return err
+	}
+	return c.MailContext(ctx, from, opts)
+}
+
+// DetectBody reads a message and returns the BODY type required to send it:
+// Body7Bit if it only contains 7-bit text, Body8BitMIME if it contains 8-bit
+// octets, and BodyBinaryMIME if it contains NUL octets, lone CRs or lines
+// longer than 998 octets, which can't be sent with DATA. Bare LFs are allowed,
+// since the writer returned by Data converts them to CRLF.
+//
+// The whole message is read, so it usually needs to be buffered, or read
+// twice, to be sent afterwards.
+func DetectBody(r io.Reader) (BodyType, error) {
+	body := Body7Bit
+	br := bufio.NewReader(r)
+	lineLen := 0
+	cr := false
+	for {
+		ch, err := br.ReadByte()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", err
+		}
+
+		if cr && ch != '\n' {
+			return BodyBinaryMIME, nil
+		}
+		cr = ch == '\r'
+
+		switch {
+		case ch == 0:
+			return BodyBinaryMIME, nil
+		case ch == '\n':
+			lineLen = 0
+			continue
+		case ch >= 0x80:
+			body = Body8BitMIME
+		}
+		if !cr {
+			lineLen++
+			if lineLen > maxTextLineLength {
+				return BodyBinaryMIME, nil
+			}
+		}
+	}
+	if cr {
+		return BodyBinaryMIME, nil
+	}
+	return body, nil
+}
+
+// mailCmd formats the MAIL command for the provided sender and options.
+func (c *Client) mailCmd(from string, opts *MailOptions) (string, error) {
+	cmdStr := "MAIL FROM:<" + from + ">"
+	var body BodyType
+	if opts != nil {
+		body = opts.Body
+	}
+	_, has8BitMIME := c.ext["8BITMIME"]
+	switch body {
+	case BodyBinaryMIME:
+		if _, ok := c.ext["BINARYMIME"]; !ok {
+			return "", errors.New("smtp: server does not support BINARYMIME")
+		}
+		cmdStr += " BODY=BINARYMIME"
+	case Body8BitMIME:
+		if !has8BitMIME {
+			return "", errors.New("smtp: server does not support 8BITMIME")
+		}
 		cmdStr += " BODY=8BITMIME"
+	case Body7Bit:
+		// The BODY parameter is only defined by the 8BITMIME extension
+		if has8BitMIME {
+			cmdStr += " BODY=7BIT"
+		}
+	case "":
+		if has8BitMIME {
+			cmdStr += " BODY=8BITMIME"
+		}
+	default:
+		return "", fmt.Errorf("smtp: unknown BODY value %q", body)
 	}
-	if _, ok := c.ext["SIZE"]; ok && opts != nil && opts.Size != 0 {
+	if maxSize, ok := c.maxMessageSize(); ok && opts != nil && opts.Size != 0 {
+		if maxSize > 0 && opts.Size > maxSize {
+			return "", &SizeExceededError{Size: opts.Size, MaxSize: maxSize}
+		}
 		cmdStr += " SIZE=" + strconv.Itoa(opts.Size)
 	}
 	if opts != nil && opts.RequireTLS {
+		if !c.tls {
+			return "", errors.New("smtp: REQUIRETLS cannot be used over a cleartext connection")
+		}
 		if _, ok := c.ext["REQUIRETLS"]; ok {
 			cmdStr += " REQUIRETLS"
 		} else {
-			return errors.New("smtp: server does not support REQUIRETLS")
+			return "", errors.New("smtp: server does not support REQUIRETLS")
 		}
 	}
 	if opts != nil && opts.UTF8 {
 		if _, ok := c.ext["SMTPUTF8"]; ok {
 			cmdStr += " SMTPUTF8"
 		} else {
-			return errors.New("smtp: server does not support SMTPUTF8")
+			return "", errors.New("smtp: server does not support SMTPUTF8")
+		}
+	}
+	if opts != nil && opts.Priority != 0 {
+		if opts.Priority < -9 || opts.Priority > 9 {
+			return "", fmt.Errorf("smtp: invalid MT-PRIORITY value %v, must be between -9 and 9", opts.Priority)
+		}
+		if _, ok := c.ext["MT-PRIORITY"]; ok {
+			cmdStr += " MT-PRIORITY=" + strconv.Itoa(opts.Priority)
+		}
+		// The priority is only a hint, it can be discarded if the server
+		// does not support MT-PRIORITY.
+	}
+	if opts != nil && opts.DeliverBy != 0 {
+		by, err := c.deliverByParam(opts.DeliverBy, opts.DeliverByMode)
+		if err != nil {
+			return "", err
 		}
+		cmdStr += by
 	}
 	if opts != nil && opts.Auth != nil {
 		if _, ok := c.ext["AUTH"]; ok {
@@ -406,100 +1441,943 @@ func (c *Client) Mail(from string, opts *MailOptions) error {
 		}
 		// We can safely discard parameter if server does not support AUTH.
 	}
-	_, _, err := c.cmd(250, cmdStr, from)
-	return err
+	if opts != nil && (opts.Ret != "" || opts.EnvelopeID != "") {
+		if _, ok := c.ext["DSN"]; !ok {
+			return "", errors.New("smtp: server does not support DSN")
+		}
+		switch opts.Ret {
+		case "":
+		case DSNReturnFull, DSNReturnHeaders:
+			cmdStr += " RET=" + string(opts.Ret)
+		default:
+			return "", fmt.Errorf("smtp: unknown RET value %q", opts.Ret)
+		}
+		if opts.EnvelopeID != "" {
+			cmdStr += " ENVID=" + encodeXtext(opts.EnvelopeID)
+		}
+	}
+	return cmdStr, nil
+}
+
+// deliverByParam formats the BY= argument of the MAIL command. An empty
+// string is returned if the server does not support DELIVERBY.
+func (c *Client) deliverByParam(d time.Duration, mode DeliverByMode) (string, error) {
+	if d < 0 {
+		return "", errors.New("smtp: DELIVERBY time must be positive")
+	}
+	switch mode {
+	case "":
+		mode = DeliverByReturn
+	case DeliverByReturn, DeliverByNotify:
+	default:
+		return "", fmt.Errorf("smtp: unknown DELIVERBY mode %q", mode)
+	}
+
+	param, ok := c.ext["DELIVERBY"]
+	if !ok {
+		// The deadline can be discarded if the server does not support
+		// DELIVERBY, it's only a hint.
+		return "", nil
+	}
+
+	// Round up to the next second
+	by := int64((d + time.Second - 1) / time.Second)
+	if mode == DeliverByReturn && param != "" {
+		// The server rejects return requests below its minimum by-time
+		if minBy, err := strconv.ParseInt(param, 10, 64); err == nil && by < minBy {
+			return "", fmt.Errorf("smtp: DELIVERBY time (%vs) is below the server minimum (%vs)", by, minBy)
+		}
+	}
+	return fmt.Sprintf(" BY=%v;%v", by, mode), nil
 }
 
 // Rcpt issues a RCPT command to the server using the provided email address.
 // A call to Rcpt must be preceded by a call to Mail and may be followed by
 // a Data call or another Rcpt call.
 //
+// If opts is not nil, RCPT arguments provided in the structure will be added
+// to the command. DSN options are only sent if the server supports the DSN
+// extension, an error is returned otherwise.
+//
 // If server returns an error, it will be of type *SMTPError.
-func (c *Client) Rcpt(to string) error {
-	if err := validateLine(to); err != nil {
+func (c *Client) Rcpt(to string, opts *RcptOptions) error {
+	return c.RcptContext(context.Background(), to, opts)
+}
+
+// RcptContext is like Rcpt, but aborts the command when ctx is done.
+func (c *Client) RcptContext(ctx context.Context, to string, opts *RcptOptions) error {
+	if err := ValidateAddress(to); err != nil {
+		return err
+	}
+	return c.withContext(ctx, func() error {
+		return c.rcpt(to, opts)
+	})
+}
+
+// Rcpts issues a RCPT command for each of the provided email addresses, and
+// doesn't stop at the first rejected recipient: the message can then be sent
+// to the accepted ones.
+//
+// Duplicate addresses are only sent once.
+//
+// The returned map contains an error for each rejected recipient, usually an
+// *SMTPError, or the error returned by ValidateAddress. An error is returned
+// only if the connection can't be used anymore, e.g. after a 421 reply or a
+// network error, along with the errors collected so far.
+func (c *Client) Rcpts(to []string) (map[string]error, error) {
+	return c.RcptsContext(context.Background(), to)
+}
+
+// RcptsContext is like Rcpts, but aborts the commands when ctx is done.
+func (c *Client) RcptsContext(ctx context.Context, to []string) (map[string]error, error) {
+	rejected := make(map[string]error)
+	seen := make(map[string]bool, len(to))
+	for _, addr := range to {
+		if err := ValidateAddress(addr); err != nil {
+			rejected[addr] = err
+			continue
+		}
+		key := rcptKey(addr)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		err := c.withContext(ctx, func() error {
+			return c.rcpt(addr, nil)
+		})
+		if _, ok := err.(*SMTPError); ok {
+			rejected[addr] = err
+		} else if err != nil {
+			return rejected, err
+		}
+	}
+	return rejected, nil
+}
+
+func (c *Client) rcpt(to string, opts *RcptOptions) error {
+	cmdStr, err := c.rcptCmd(to, opts)
+	if err != nil {
 		return err
 	}
-	if _, _, err := c.cmd(25, "RCPT TO:<%s>", to); err != nil {
+	if _, _, err := c.cmd(25, "%s", cmdStr); err != nil {
 		return err
 	}
 	c.rcpts = append(c.rcpts, to)
 	return nil
 }
 
+// rcptCmd formats the RCPT command for the provided recipient and options.
+func (c *Client) rcptCmd(to string, opts *RcptOptions) (string, error) {
+	cmdStr := "RCPT TO:<" + to + ">"
+	if opts != nil && (len(opts.Notify) != 0 || opts.OrigRcpt != "") {
+		if _, ok := c.ext["DSN"]; !ok {
+			return "", errors.New("smtp: server does not support DSN")
+		}
+		if len(opts.Notify) != 0 {
+			notify, err := formatDSNNotify(opts.Notify)
+			if err != nil {
+				return "", err
+			}
+			cmdStr += " NOTIFY=" + notify
+		}
+		if opts.OrigRcpt != "" {
+			cmdStr += " ORCPT=rfc822;" + encodeXtext(opts.OrigRcpt)
+		}
+	}
+	return cmdStr, nil
+}
+
+// formatDSNNotify formats the value of the NOTIFY= argument, as defined in
+// RFC 3461 section 4.1.
+func formatDSNNotify(notify []DSNNotify) (string, error) {
+	l := make([]string, 0, len(notify))
+	for _, n := range notify {
+		switch n {
+		case DSNNotifyNever:
+			if len(notify) != 1 {
+				return "", errors.New("smtp: NOTIFY=NEVER cannot be combined with other values")
+			}
+		case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelay:
+		default:
+			return "", fmt.Errorf("smtp: unknown NOTIFY value %q", n)
+		}
+		l = append(l, string(n))
+	}
+	return strings.Join(l, ","), nil
+}
+
+// LMTPStatus is the reply sent by a LMTP server for a single recipient once a
+// message has been transferred.
+type LMTPStatus struct {
+	Rcpt         string
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+// Err returns the reply as an *SMTPError if it's negative, nil otherwise.
+func (s *LMTPStatus) Err() error {
+	if s.Code/100 == 2 {
+		return nil
+	}
+	return &SMTPError{Code: s.Code, EnhancedCode: s.EnhancedCode, Message: s.Message}
+}
+
+// DataResponse is the reply sent by the server once a message has been
+// accepted. The message often contains a queue ID, which can be used to track
+// the message.
+type DataResponse struct {
+	Code         int
+	EnhancedCode EnhancedCode
+	Message      string
+}
+
+// DataWriter is the writer returned by Data and BData.
+type DataWriter interface {
+	io.WriteCloser
+
+	// Response returns the reply sent by the server once the message has
+	// been accepted. It must be called after a successful Close. It returns
+	// nil for LMTP clients, see LMTPDataWriter instead.
+	Response() *DataResponse
+
+	// Abort gives up on the message transfer. SMTP has no way to cancel a
+	// transfer once it has begun: the message can only be terminated, which
+	// would deliver it partially. So Abort closes the connection, and the
+	// server discards the partial message. Afterwards, the writer and the
+	// Client return an *AbortedError.
+	//
+	// Abort must not be called concurrently with Write or Close: use a
+	// context with DataContext to interrupt a blocked write.
+	Abort() error
+}
+
+// LMTPDataWriter is the writer returned by Data and LMTPData for LMTP clients.
+type LMTPDataWriter interface {
+	io.WriteCloser
+
+	// Statuses returns the replies sent by the server for each recipient, in
+	// the order of the Rcpt calls. It must be called after Close.
+	Statuses() []LMTPStatus
+
+	// Abort gives up on the message transfer, see DataWriter.
+	Abort() error
+}
+
+// AbortedError is returned once a message transfer has been aborted with
+// DataWriter.Abort. The connection has been closed.
+type AbortedError struct{}
+
+func (err *AbortedError) Error() string {
+	return "smtp: message transfer aborted"
+}
+
+// abortData closes the connection in the middle of a message transfer and
+// leaves the Client unusable.
+func (c *Client) abortData() error {
+	c.mu.Lock()
+	c.inData = false
+	c.binarymime = false
+	c.err = &AbortedError{}
+	c.mu.Unlock()
+
+	// Close waits for the keep-alive goroutine, which may need mu
+	return c.Close()
+}
+
 type dataCloser struct {
 	c *Client
 	io.WriteCloser
-	statusCb func(rcpt string, status *SMTPError)
+	statusCb  func(rcpt string, status *SMTPError)
+	ctx       context.Context
+	statuses  []LMTPStatus
+	resp      *DataResponse
+	validator dataValidator
 }
 
-func (d *dataCloser) Close() error {
-	d.WriteCloser.Close()
-
-	d.c.conn.SetDeadline(time.Now().Add(d.c.SubmissionTimeout))
-	defer d.c.conn.SetDeadline(time.Time{})
-
-	expectedResponses := len(d.c.rcpts)
-	if d.c.lmtp {
-		for expectedResponses > 0 {
-			rcpt := d.c.rcpts[len(d.c.rcpts)-expectedResponses]
-			if _, _, err := d.c.Text.ReadResponse(250); err != nil {
-				if protoErr, ok := err.(*textproto.Error); ok {
-					if d.statusCb != nil {
-						d.statusCb(rcpt, toSMTPErr(protoErr))
-					}
-				} else {
+// Maximum length of a line of text, excluding the CRLF (RFC 5321 section
+// 4.5.3.1.6).
+const maxTextLineLength = 998
+
+// dataValidator checks a message against the Client's strict mode options.
+type dataValidator struct {
+	strictCRLF       bool
+	strictLineLength bool
+
+	offset  int64 // offset of the next byte
+	cr      bool  // whether the previous byte is a CR
+	line    int   // number of the current line, starting at 1
+	lineLen int   // length of the current line so far, once dot-stuffed
+}
+
+func (v *dataValidator) check(b []byte) error {
+	for _, ch := range b {
+		if v.strictCRLF {
+			if v.cr && ch != '\n' {
+				return fmt.Errorf("smtp: lone CR at offset %v", v.offset-1)
+			}
+			if !v.cr && ch == '\n' {
+				return fmt.Errorf("smtp: bare LF at offset %v", v.offset)
+			}
+		}
+
+		if v.line == 0 {
+			v.line = 1
+		}
+		if ch == '\n' {
+			n := v.lineLen
+			if v.cr {
+				n--
+			}
+			if err := v.checkLineLength(n); err != nil {
+				return err
+			}
+			v.line++
+			v.lineLen = 0
+		} else {
+			if v.lineLen == 0 && ch == '.' {
+				v.lineLen++
+			}
+			v.lineLen++
+			// A CR may be the beginning of the line ending
+			if ch != '\r' {
+				if err := v.checkLineLength(v.lineLen); err != nil {
 					return err
 				}
-			} else if d.statusCb != nil {
-				d.statusCb(rcpt, nil)
 			}
-			expectedResponses--
 		}
-		return nil
+
+		v.cr = ch == '\r'
+		v.offset++
+	}
+	return nil
+}
+
+func (v *dataValidator) checkLineLength(n int) error {
+	if v.strictLineLength && n > maxTextLineLength {
+		return fmt.Errorf("smtp: line %v is longer than %v octets", v.line, maxTextLineLength+2)
+	}
+	return nil
+}
+
+func (v *dataValidator) close() error {
+	if v.strictCRLF && v.cr {
+		return fmt.Errorf("smtp: lone CR at offset %v", v.offset-1)
+	}
+	// The DotWriter terminates the last line
+	n := v.lineLen
+	if v.cr {
+		n--
+	}
+	return v.checkLineLength(n)
+}
+
+func (c *Client) newDataCloser(ctx context.Context, statusCb func(rcpt string, status *SMTPError)) *dataCloser {
+	return &dataCloser{
+		c:           c,
+		WriteCloser: c.Text.DotWriter(),
+		statusCb:    statusCb,
+		ctx:         ctx,
+		validator: dataValidator{
+			strictCRLF:       c.StrictCRLF,
+			strictLineLength: c.StrictLineLength,
+		},
+	}
+}
+
+func (d *dataCloser) Write(b []byte) (int, error) {
+	var n int
+	err := d.c.withContext(d.ctx, func() error {
+		if err := d.validate(d.validator.check(b)); err != nil {
+			return err
+		}
+
+		d.c.setTimeout(d.c.CommandTimeout)
+		defer d.c.setDeadline(time.Time{})
+
+		var err error
+		n, err = d.WriteCloser.Write(b)
+		return err
+	})
+	return n, err
+}
+
+// validate leaves the connection unusable if err is non-nil. The message
+// must not be terminated, since it would be delivered partially.
+func (d *dataCloser) validate(err error) error {
+	if err != nil {
+		d.c.err = fmt.Errorf("smtp: connection unusable after invalid message: %w", err)
+	}
+	return err
+}
+
+func (d *dataCloser) Close() error {
+	return d.c.withContext(d.ctx, d.close)
+}
+
+func (d *dataCloser) close() error {
+	if err := d.validate(d.validator.close()); err != nil {
+		return err
+	}
+
+	d.c.inData = false
+
+	d.c.setTimeout(d.c.SubmissionTimeout)
+	defer d.c.setDeadline(time.Time{})
+
+	if err := d.WriteCloser.Close(); err != nil {
+		return err
+	}
+
+	var err error
+	d.resp, d.statuses, err = d.c.readDataResponse(d.statusCb)
+	return err
+}
+
+func (d *dataCloser) Abort() error {
+	return d.c.abortData()
+}
+
+func (d *dataCloser) Response() *DataResponse {
+	return d.resp
+}
+
+func (d *dataCloser) Statuses() []LMTPStatus {
+	return d.statuses
+}
+
+// readDataResponse reads the server reply sent once the message has been
+// transferred. In LMTP mode, one reply is read per recipient: the replies are
+// returned and statusCb is called for each of them.
+func (c *Client) readDataResponse(statusCb func(rcpt string, status *SMTPError)) (*DataResponse, []LMTPStatus, error) {
+	if !c.lmtp {
+		code, msg, err := c.readResponse(250)
+		if err != nil {
+			return nil, nil, err
+		}
+		reply := toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+		return &DataResponse{
+			Code:         reply.Code,
+			EnhancedCode: reply.EnhancedCode,
+			Message:      reply.Message,
+		}, nil, nil
+	}
+
+	statuses := make([]LMTPStatus, 0, len(c.rcpts))
+	for _, rcpt := range c.rcpts {
+		code, msg, err := c.Text.ReadResponse(250)
+		var smtpErr *SMTPError
+		if protoErr, ok := err.(*textproto.Error); ok {
+			smtpErr = toSMTPErr(protoErr)
+			if err := c.checkClosed(smtpErr); err != smtpErr {
+				return nil, statuses, err
+			}
+		} else if err != nil {
+			return nil, statuses, err
+		}
+
+		reply := smtpErr
+		if reply == nil {
+			reply = toSMTPErr(&textproto.Error{Code: code, Msg: msg})
+		}
+		statuses = append(statuses, LMTPStatus{
+			Rcpt:         rcpt,
+			Code:         reply.Code,
+			EnhancedCode: reply.EnhancedCode,
+			Message:      reply.Message,
+		})
+		if statusCb != nil {
+			statusCb(rcpt, smtpErr)
+		}
+	}
+	return nil, statuses, nil
+}
+
+var errBinaryMIMEData = errors.New("smtp: DATA cannot be used with a BINARYMIME body, use BData instead")
+
+// Data issues a DATA command to the server and returns a writer that
+// can be used to write the mail headers and body. The caller should
+// close the writer before calling any more methods on c. A call to
+// Data must be preceded by one or more calls to Rcpt.
+//
+// The returned writer is a DataWriter: once it has been closed, the reply of
+// the server, which often contains a queue ID, can be retrieved with Response.
+// For LMTP clients, it's a LMTPDataWriter as well: the replies for each
+// recipient can be retrieved with Statuses.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) Data() (io.WriteCloser, error) {
+	return c.DataContext(context.Background())
+}
+
+// DataContext is like Data, but aborts the command when ctx is done. The
+// returned writer is bound to ctx as well: writes and the final Close are
+// aborted when ctx is done.
+func (c *Client) DataContext(ctx context.Context) (io.WriteCloser, error) {
+	if c.binarymime {
+		return nil, errBinaryMIMEData
+	}
+	err := c.withContext(ctx, func() error {
+		_, _, err := c.cmd(354, "DATA")
+		c.inData = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newDataCloser(ctx, nil), nil
+}
+
+// LMTPData is the LMTP-specific version of the Data method. It accepts a callback
+// that will be called for each status response received from the server.
+//
+// Status callback will receive a SMTPError argument for each negative server
+// reply and nil for each positive reply. I/O errors will not be reported using
+// callback and instead will be returned by the Close method of io.WriteCloser.
+// Callback will be called for each successfull Rcpt call done before in the
+// same order.
+//
+// The returned writer is a LMTPDataWriter, so the replies can also be
+// retrieved with Statuses once it has been closed.
+func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.WriteCloser, error) {
+	return c.LMTPDataContext(context.Background(), statusCb)
+}
+
+// LMTPDataContext is like LMTPData, but aborts the command when ctx is done.
+// As with DataContext, the returned writer is bound to ctx.
+func (c *Client) LMTPDataContext(ctx context.Context, statusCb func(rcpt string, status *SMTPError)) (io.WriteCloser, error) {
+	if !c.lmtp {
+		return nil, errors.New("smtp: not a LMTP client")
+	}
+	if c.binarymime {
+		return nil, errBinaryMIMEData
+	}
+
+	err := c.withContext(ctx, func() error {
+		_, _, err := c.cmd(354, "DATA")
+		c.inData = err == nil
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return c.newDataCloser(ctx, statusCb), nil
+}
+
+// DefaultChunkSize is the default maximum size of the chunks sent by BData.
+const DefaultChunkSize = 64 * 1024
+
+type bdatWriter struct {
+	c        *Client
+	ctx      context.Context
+	buf      []byte
+	err      error
+	resp     *DataResponse
+	statuses []LMTPStatus
+}
+
+func (w *bdatWriter) Write(b []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	n := 0
+	for len(b) > 0 {
+		m := copy(w.buf[len(w.buf):cap(w.buf)], b)
+		w.buf = w.buf[:len(w.buf)+m]
+		n += m
+		b = b[m:]
+
+		if len(w.buf) == cap(w.buf) {
+			w.err = w.c.withContext(w.ctx, func() error {
+				_, _, err := w.c.bdat(w.buf, false)
+				return err
+			})
+			w.buf = w.buf[:0]
+			if w.err != nil {
+				return n, w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+func (w *bdatWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = errors.New("smtp: BDAT writer already closed")
+	return w.c.withContext(w.ctx, func() error {
+		w.c.inData = false
+		w.c.binarymime = false
+		var err error
+		w.resp, w.statuses, err = w.c.bdat(w.buf, true)
+		return err
+	})
+}
+
+func (w *bdatWriter) Abort() error {
+	err := w.c.abortData()
+	w.err = w.c.err
+	return err
+}
+
+func (w *bdatWriter) Response() *DataResponse {
+	return w.resp
+}
+
+func (w *bdatWriter) Statuses() []LMTPStatus {
+	return w.statuses
+}
+
+// bdat sends a single BDAT chunk and reads the reply. The reply to the last
+// chunk is returned, or the replies for each recipient in LMTP mode.
+func (c *Client) bdat(chunk []byte, last bool) (*DataResponse, []LMTPStatus, error) {
+	if c.err != nil {
+		return nil, nil, c.err
+	}
+
+	timeout := c.CommandTimeout
+	if last {
+		timeout = c.SubmissionTimeout
+	}
+	c.setTimeout(timeout)
+	defer c.setDeadline(time.Time{})
+
+	c.lastCmd = "BDAT"
+	if last {
+		fmt.Fprintf(c.Text.W, "BDAT %d LAST\r\n", len(chunk))
 	} else {
-		_, _, err := d.c.Text.ReadResponse(250)
+		fmt.Fprintf(c.Text.W, "BDAT %d\r\n", len(chunk))
+	}
+	if _, err := c.Text.W.Write(chunk); err != nil {
+		return nil, nil, err
+	}
+	if err := c.Text.W.Flush(); err != nil {
+		return nil, nil, err
+	}
+
+	if last {
+		return c.readDataResponse(nil)
+	}
+	_, _, err := c.readResponse(250)
+	return nil, nil, err
+}
+
+// BData returns a writer that can be used to write the mail headers and body
+// using BDAT commands, as defined in RFC 3030. Only servers that advertise
+// the CHUNKING extension support this function.
+//
+// Written data is buffered and sent in chunks of at most ChunkSize bytes,
+// without dot-stuffing. The last chunk is sent when the writer is closed. The
+// caller should close the writer before calling any more methods on c. A call
+// to BData must be preceded by one or more calls to Rcpt.
+//
+// The returned writer is a DataWriter: once it has been closed, the reply of
+// the server can be retrieved with Response. For LMTP clients, it's a
+// LMTPDataWriter as well: as with Data, the replies for each recipient are
+// sent after the last chunk and can be retrieved with Statuses.
+//
+// If server returns an error, it will be of type *SMTPError.
+func (c *Client) BData() (io.WriteCloser, error) {
+	return c.BDataContext(context.Background())
+}
+
+// BDataContext is like BData, but the returned writer is bound to ctx: writes
+// and the final Close are aborted when ctx is done.
+func (c *Client) BDataContext(ctx context.Context) (io.WriteCloser, error) {
+	err := c.withContext(ctx, func() error {
+		if _, ok := c.ext["CHUNKING"]; !ok {
+			return errors.New("smtp: server does not support CHUNKING")
+		}
+		c.inData = true
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := c.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = DefaultChunkSize
+	}
+	return &bdatWriter{c: c, ctx: ctx, buf: make([]byte, 0, chunkSize)}, nil
+}
+
+// Pipeline queues the commands of a mail transaction (MAIL, RCPT and DATA) to
+// send them in a single batch, as defined in RFC 2920. A Pipeline is created
+// by Client.Pipeline.
+//
+// If the server does not advertise the PIPELINING extension, the queued
+// commands are sent one by one.
+type Pipeline struct {
+	c *Client
+
+	mail     bool
+	from     string
+	mailOpts *MailOptions
+	rcpts    []pipelineRcpt
+	data     bool
+
+	err error
+}
+
+type pipelineRcpt struct {
+	to   string
+	opts *RcptOptions
+}
+
+// RcptError describes a recipient rejected by the server.
+type RcptError struct {
+	Rcpt string
+	Err  *SMTPError
+}
+
+// PipelineError is returned by Pipeline.Execute when the server rejects some
+// of the pipelined commands.
+type PipelineError struct {
+	// Error returned for the MAIL command, if any.
+	Mail *SMTPError
+	// Errors returned for the RCPT commands, in the order they were queued.
+	Rcpts []RcptError
+	// Error returned for the DATA command, if any.
+	Data *SMTPError
+}
+
+func (err *PipelineError) Error() string {
+	var l []string
+	if err.Mail != nil {
+		l = append(l, "MAIL: "+err.Mail.Error())
+	}
+	for _, rcptErr := range err.Rcpts {
+		l = append(l, fmt.Sprintf("RCPT <%v>: %v", rcptErr.Rcpt, rcptErr.Err))
+	}
+	if err.Data != nil {
+		l = append(l, "DATA: "+err.Data.Error())
+	}
+	return "smtp: " + strings.Join(l, "; ")
+}
+
+// Pipeline returns a new Pipeline for this client.
+func (c *Client) Pipeline() *Pipeline {
+	return &Pipeline{c: c}
+}
+
+// Mail queues a MAIL command. See Client.Mail.
+func (p *Pipeline) Mail(from string, opts *MailOptions) {
+	if err := ValidateAddress(from); err != nil && p.err == nil {
+		p.err = err
+	}
+	p.mail = true
+	p.from = from
+	p.mailOpts = opts
+}
+
+// Rcpt queues a RCPT command. See Client.Rcpt.
+func (p *Pipeline) Rcpt(to string, opts *RcptOptions) {
+	if err := ValidateAddress(to); err != nil && p.err == nil {
+		p.err = err
+	}
+	p.rcpts = append(p.rcpts, pipelineRcpt{to, opts})
+}
+
+// Data queues a DATA command. It must be the last queued command.
+func (p *Pipeline) Data() {
+	p.data = true
+}
+
+// Execute sends all the queued commands and reads back their replies, in
+// order. All replies are read even if a command fails, so that the client
+// stays in sync with the server.
+//
+// If the server rejects some of the commands, the returned error will be of
+// type *PipelineError. If DATA was queued and accepted by the server, a
+// writer is returned along with the error (if some recipients were
+// rejected): the message must be written to it and it must be closed before
+// calling any more methods on the client, as with Client.Data.
+func (p *Pipeline) Execute() (io.WriteCloser, error) {
+	return p.ExecuteContext(context.Background())
+}
+
+// ExecuteContext is like Execute, but aborts the commands when ctx is done.
+// The returned writer is bound to ctx, as with Client.DataContext.
+func (p *Pipeline) ExecuteContext(ctx context.Context) (io.WriteCloser, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	if p.data && ((p.mail && p.mailOpts != nil && p.mailOpts.Body == BodyBinaryMIME) || (!p.mail && p.c.binarymime)) {
+		return nil, errBinaryMIMEData
+	}
+	var w io.WriteCloser
+	err := p.c.withContext(ctx, func() error {
+		var err error
+		w, err = p.execute(ctx)
+		return err
+	})
+	if p.c.err != nil {
+		return nil, err
+	}
+	return w, err
+}
+
+func (p *Pipeline) execute(ctx context.Context) (io.WriteCloser, error) {
+	c := p.c
+	if err := c.hello(); err != nil {
+		return nil, err
+	}
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	var cmds []string
+	var expectCodes []int
+	if p.mail {
+		cmdStr, err := c.mailCmd(p.from, p.mailOpts)
+		if err != nil {
+			return nil, err
+		}
+		cmds = append(cmds, cmdStr)
+		expectCodes = append(expectCodes, 250)
+	}
+	for _, rcpt := range p.rcpts {
+		cmdStr, err := c.rcptCmd(rcpt.to, rcpt.opts)
 		if err != nil {
-			if protoErr, ok := err.(*textproto.Error); ok {
-				return toSMTPErr(protoErr)
+			return nil, err
+		}
+		cmds = append(cmds, cmdStr)
+		expectCodes = append(expectCodes, 25)
+	}
+	if p.data {
+		cmds = append(cmds, "DATA")
+		expectCodes = append(expectCodes, 354)
+	}
+
+	c.setTimeout(c.CommandTimeout)
+	defer c.setDeadline(time.Time{})
+
+	_, pipelining := c.ext["PIPELINING"]
+	errs := make([]*SMTPError, len(cmds))
+	read := 0
+	for i, cmdStr := range cmds {
+		if _, err := c.Text.W.WriteString(cmdStr + "\r\n"); err != nil {
+			return nil, err
+		}
+		if pipelining && i < len(cmds)-1 {
+			continue
+		}
+		if err := c.Text.W.Flush(); err != nil {
+			return nil, err
+		}
+		for ; read <= i; read++ {
+			c.lastCmd = commandName(cmds[read])
+			_, _, err := c.readResponse(expectCodes[read])
+			if smtpErr, ok := err.(*SMTPError); ok {
+				errs[read] = smtpErr
+			} else if err != nil {
+				return nil, err
 			}
-			return err
 		}
-		return nil
 	}
-}
 
-// Data issues a DATA command to the server and returns a writer that
-// can be used to write the mail headers and body. The caller should
-// close the writer before calling any more methods on c. A call to
-// Data must be preceded by one or more calls to Rcpt.
-//
-// If server returns an error, it will be of type *SMTPError.
-func (c *Client) Data() (io.WriteCloser, error) {
-	_, _, err := c.cmd(354, "DATA")
-	if err != nil {
-		return nil, err
+	pErr := &PipelineError{}
+	i := 0
+	if p.mail {
+		pErr.Mail = errs[i]
+		if pErr.Mail == nil {
+			c.rcpts = nil
+			c.binarymime = p.mailOpts != nil && p.mailOpts.Body == BodyBinaryMIME
+		}
+		i++
+	}
+	for _, rcpt := range p.rcpts {
+		if errs[i] != nil {
+			pErr.Rcpts = append(pErr.Rcpts, RcptError{Rcpt: rcpt.to, Err: errs[i]})
+		} else {
+			c.rcpts = append(c.rcpts, rcpt.to)
+		}
+		i++
+	}
+	noRcpt := len(p.rcpts) != 0 && len(pErr.Rcpts) == len(p.rcpts)
+
+	var w io.WriteCloser
+	if p.data {
+		pErr.Data = errs[i]
+		if pErr.Data == nil && (pErr.Mail != nil || noRcpt) {
+			// The server accepted DATA although there is no valid
+			// transaction, send an empty message to keep in sync (RFC 2920
+			// section 3.1).
+			if err := c.Text.PrintfLine("."); err != nil {
+				return nil, err
+			}
+			if _, _, err := c.readResponse(0); err != nil {
+				return nil, err
+			}
+		} else if pErr.Data == nil {
+			w = c.newDataCloser(ctx, nil)
+			c.inData = true
+		}
+	}
+
+	if pErr.Mail != nil || len(pErr.Rcpts) != 0 || pErr.Data != nil {
+		return w, pErr
 	}
-	return &dataCloser{c, c.Text.DotWriter(), nil}, nil
+	return w, nil
 }
 
-// LMTPData is the LMTP-specific version of the Data method. It accepts a callback
-// that will be called for each status response received from the server.
+// Send sends a message on the connection, from address from, to addresses to,
+// with message r. It issues MAIL, RCPT and DATA commands, writes the message,
+// then issues RSET so that the session is in a clean state for the next one.
 //
-// Status callback will receive a SMTPError argument for each negative server
-// reply and nil for each positive reply. I/O errors will not be reported using
-// callback and instead will be returned by the Close method of io.WriteCloser.
-// Callback will be called for each successfull Rcpt call done before in the
-// same order.
-func (c *Client) LMTPData(statusCb func(rcpt string, status *SMTPError)) (io.WriteCloser, error) {
-	if !c.lmtp {
-		return nil, errors.New("smtp: not a LMTP client")
+// Send can be called repeatedly to send multiple messages on the same
+// connection, without greeting, starting TLS or authenticating again:
+//
+//	for _, msg := range msgs {
+//		if err := c.Send(msg.From, msg.To, msg.Body); err != nil {
+//			log.Print(err)
+//		}
+//	}
+//
+// If the transaction fails, Send aborts it with RSET so that the connection
+// can be used to send the next message. If the transaction can't be aborted
+// (RSET fails or the message couldn't be read from r), the connection is
+// closed. If RSET fails after the message has been accepted, the connection
+// is closed too, but no error is returned since the message was delivered.
+func (c *Client) Send(from string, to []string, r io.Reader) error {
+	return c.SendContext(context.Background(), from, to, r)
+}
+
+// SendContext is like Send, but aborts the transaction when ctx is done. In
+// this case, the connection is closed.
+func (c *Client) SendContext(ctx context.Context, from string, to []string, r io.Reader) error {
+	abort := func(err error) error {
+		if rerr := c.ResetContext(ctx); rerr != nil {
+			c.Close()
+		}
+		return err
 	}
 
-	_, _, err := c.cmd(354, "DATA")
+	if err := c.MailContext(ctx, from, nil); err != nil {
+		return abort(err)
+	}
+	for _, addr := range to {
+		if err := c.RcptContext(ctx, addr, nil); err != nil {
+			return abort(err)
+		}
+	}
+	w, err := c.DataContext(ctx)
 	if err != nil {
-		return nil, err
+		return abort(err)
 	}
-	return &dataCloser{c, c.Text.DotWriter(), statusCb}, nil
+	if _, err := io.Copy(w, r); err != nil {
+		// Terminating the DATA command would deliver a truncated message
+		c.Close()
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return abort(err)
+	}
+	if err := c.ResetContext(ctx); err != nil {
+		c.Close()
+	}
+	return nil
 }
 
 var testHookStartTLS func(*tls.Config) // nil, except for tests
@@ -509,7 +2387,8 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // addresses to, with message r. The addr must include a port, as in
 // "mail.example.com:smtp".
 //
-// The addresses in the to parameter are the SMTP RCPT addresses.
+// The addresses in the to parameter are the SMTP RCPT addresses. They're
+// checked before connecting: invalid and duplicate addresses are rejected.
 //
 // The r parameter should be an RFC 822-style email with headers
 // first, a blank line, and then the message body. The lines of r
@@ -526,57 +2405,449 @@ var testHookStartTLS func(*tls.Config) // nil, except for tests
 // attachments (see the mime/multipart package or the go-message package), or
 // other mail functionality.
 func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader) error {
-	if err := validateLine(from); err != nil {
+	return SendMailWithOptions(addr, a, from, to, r, nil)
+}
+
+// SendOptions contains options for SendMailWithOptions.
+type SendOptions struct {
+	// Arguments of the MAIL command. If Body is BodyBinaryMIME, the message
+	// is sent with BDAT.
+	Mail *MailOptions
+	// Arguments of the RCPT command, for all recipients.
+	Rcpt *RcptOptions
+	// Arguments of the RCPT command for specific recipients, by address as
+	// passed to SendMailWithOptions. They take precedence over Rcpt: an entry
+	// replaces Rcpt as a whole, fields aren't merged.
+	RcptByAddr map[string]*RcptOptions
+}
+
+func (opts *SendOptions) mailOptions() *MailOptions {
+	if opts == nil {
+		return nil
+	}
+	return opts.Mail
+}
+
+func (opts *SendOptions) rcptOptions(addr string) *RcptOptions {
+	if opts == nil {
+		return nil
+	}
+	if rcptOpts, ok := opts.RcptByAddr[addr]; ok {
+		return rcptOpts
+	}
+	return opts.Rcpt
+}
+
+// SendMailWithOptions is like SendMail, but allows passing arguments to the
+// MAIL and RCPT commands, e.g. to request DSNs or to send internationalized
+// mail. A nil opts is equivalent to a zero SendOptions.
+func SendMailWithOptions(addr string, a sasl.Client, from string, to []string, r io.Reader, opts *SendOptions) error {
+	if err := validateSendMail(from, to); err != nil {
 		return err
 	}
-	for _, recp := range to {
-		if err := validateLine(recp); err != nil {
-			return err
-		}
+	c, err := Dial(addr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.sendMail(a, from, to, r, opts, false, nil); err != nil {
+		// Try to say goodbye politely, but report the original error
+		c.Quit()
+		return err
+	}
+	return c.Quit()
+}
+
+// SendResult describes how a message was sent by SendMailWithResult.
+type SendResult struct {
+	// Recipients accepted by the server, in order.
+	Accepted []string
+	// Recipients rejected by the server, in order.
+	Rejected []RcptError
+	// Reply of the server once the message has been sent, or nil if it
+	// hasn't been sent.
+	Response *DataResponse
+	// Queue ID assigned to the message by the server, if it could be found in
+	// Response, e.g. "250 2.0.0 Ok: queued as 4C9F1A2B3". Empty otherwise.
+	QueueID string
+	// Whether the message was sent over TLS.
+	TLS bool
+	// SASL mechanism used to authenticate, or empty if the client didn't
+	// authenticate.
+	AuthMechanism string
+}
+
+// SendMailWithResult is like SendMailWithOptions, but returns what happened
+// to the message. Unlike SendMail, recipients rejected by the server don't
+// abort the transaction: the message is sent to the accepted recipients, and
+// the rejected ones are reported in the result. An error is returned if all
+// recipients are rejected.
+//
+// The result is returned even if an error occurs, and describes what was
+// done until then.
+func SendMailWithResult(addr string, a sasl.Client, from string, to []string, r io.Reader, opts *SendOptions) (*SendResult, error) {
+	res := &SendResult{}
+	if err := validateSendMail(from, to); err != nil {
+		return res, err
 	}
 	c, err := Dial(addr)
+	if err != nil {
+		return res, err
+	}
+	defer c.Close()
+	if err := c.sendMail(a, from, to, r, opts, false, res); err != nil {
+		// Try to say goodbye politely, but report the original error
+		c.Quit()
+		return res, err
+	}
+	return res, c.Quit()
+}
+
+// parseQueueID extracts the queue ID from the reply to DATA, for servers
+// which use the "queued as <id>" convention, e.g. Postfix.
+func parseQueueID(msg string) string {
+	const prefix = "queued as "
+	i := strings.Index(strings.ToLower(msg), prefix)
+	if i < 0 {
+		return ""
+	}
+	fields := strings.Fields(msg[i+len(prefix):])
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.Trim(fields[0], "<>().,;")
+}
+
+// SendMailConn is like SendMail, but uses an existing connection to the
+// server instead of dialing addr. This allows callers to use their own
+// dialing logic, e.g. to go through a proxy. host is the server name used to
+// verify its certificate.
+//
+// The greeting is read from conn, then EHLO is sent. STARTTLS is used if the
+// server supports it, unless conn already uses TLS. Authentication is
+// refused if the connection isn't encrypted. conn is closed once done.
+func SendMailConn(conn net.Conn, host string, a sasl.Client, from string, to []string, r io.Reader) error {
+	if err := validateSendMail(from, to); err != nil {
+		conn.Close()
+		return err
+	}
+	c, err := NewClient(conn, host)
 	if err != nil {
 		return err
 	}
 	defer c.Close()
-	if err = c.hello(); err != nil {
+	if err := c.sendMail(a, from, to, r, nil, true, nil); err != nil {
+		// Try to say goodbye politely, but report the original error
+		c.Quit()
+		return err
+	}
+	return c.Quit()
+}
+
+func validateSendMail(from string, to []string) error {
+	if err := ValidateAddress(from); err != nil {
 		return err
 	}
-	if ok, _ := c.Extension("STARTTLS"); !ok {
-		return errors.New("smtp: server doesn't support STARTTLS")
+	seen := make(map[string]bool, len(to))
+	for _, recp := range to {
+		if err := ValidateAddress(recp); err != nil {
+			return err
+		}
+		key := rcptKey(recp)
+		if seen[key] {
+			return fmt.Errorf("smtp: duplicate recipient %q", recp)
+		}
+		seen[key] = true
 	}
-	if err = c.StartTLS(nil); err != nil {
+	return nil
+}
+
+// rcptKey returns a key identifying a recipient address. The domain is
+// case-insensitive, but the local part isn't (RFC 5321 section 2.4).
+func rcptKey(addr string) string {
+	i := strings.LastIndexByte(addr, '@')
+	if i < 0 {
+		return addr
+	}
+	return addr[:i+1] + strings.ToLower(addr[i+1:])
+}
+
+// sendMail sends a message with STARTTLS. If opportunisticTLS is true, the
+// message is sent in cleartext if the server doesn't support STARTTLS.
+//
+// If res is non-nil, it's filled as the message is sent, and recipients
+// rejected by the server are skipped instead of aborting the transaction.
+func (c *Client) sendMail(a sasl.Client, from string, to []string, r io.Reader, opts *SendOptions, opportunisticTLS bool, res *SendResult) error {
+	if err := c.hello(); err != nil {
 		return err
 	}
+	if opportunisticTLS {
+		if !c.tls {
+			if _, err := c.StartTLSOpportunistic(nil); err != nil {
+				return err
+			}
+		}
+		if a != nil && !c.tls {
+			return errors.New("smtp: refusing to authenticate over a cleartext connection")
+		}
+	} else {
+		if ok, _ := c.Extension("STARTTLS"); !ok {
+			return errors.New("smtp: server doesn't support STARTTLS")
+		}
+		if err := c.StartTLS(nil); err != nil {
+			return err
+		}
+	}
 	if a != nil && c.ext != nil {
 		if _, ok := c.ext["AUTH"]; !ok {
 			return errors.New("smtp: server doesn't support AUTH")
 		}
-		if err = c.Auth(a); err != nil {
+		if err := c.Auth(a); err != nil {
 			return err
 		}
 	}
-	if err = c.Mail(from, nil); err != nil {
+	if res != nil {
+		res.TLS = c.tls
+		res.AuthMechanism = c.authMech
+	}
+	mailOpts := opts.mailOptions()
+	if err := c.Mail(from, mailOpts); err != nil {
 		return err
 	}
 	for _, addr := range to {
-		if err = c.Rcpt(addr); err != nil {
+		err := c.Rcpt(addr, opts.rcptOptions(addr))
+		if smtpErr, ok := err.(*SMTPError); ok && res != nil {
+			res.Rejected = append(res.Rejected, RcptError{Rcpt: addr, Err: smtpErr})
+			continue
+		} else if err != nil {
 			return err
 		}
+		if res != nil {
+			res.Accepted = append(res.Accepted, addr)
+		}
+	}
+	if res != nil && len(res.Accepted) == 0 {
+		return errors.New("smtp: all recipients were rejected")
+	}
+	var w io.WriteCloser
+	var err error
+	if mailOpts != nil && mailOpts.Body == BodyBinaryMIME {
+		w, err = c.BData()
+	} else {
+		w, err = c.Data()
 	}
-	w, err := c.Data()
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(w, r)
-	if err != nil {
+	if _, err := io.Copy(w, r); err != nil {
 		return err
 	}
-	err = w.Close()
-	if err != nil {
+	if err := w.Close(); err != nil {
 		return err
 	}
-	return c.Quit()
+	if res != nil {
+		res.Response = w.(DataWriter).Response()
+		if res.Response != nil {
+			res.QueueID = parseQueueID(res.Response.Message)
+		}
+	}
+	return nil
+}
+
+// lookupMX and mxPort can be overridden by tests.
+var (
+	lookupMX = net.DefaultResolver.LookupMX
+	mxPort   = "25"
+)
+
+// SendMailMX delivers a message directly to the mail exchangers of the
+// recipient domains, from address from, to addresses to, with message r.
+//
+// Recipients are grouped by domain. For each domain, the MX hosts are tried
+// by order of preference until one of them accepts the message. If the domain
+// has no MX record, the domain itself is used. STARTTLS is used if the server
+// supports it. As usual for opportunistic TLS between MTAs, the server
+// certificate isn't verified: this only protects against passive attackers.
+//
+// ctx bounds the whole delivery, across all hosts.
+//
+// The returned map contains an error for each recipient the message couldn't
+// be delivered to. The message is read in memory before being sent. An error
+// is returned if the arguments are invalid or if r can't be read.
+func SendMailMX(ctx context.Context, from string, to []string, r io.Reader) (map[string]error, error) {
+	if err := validateSendMail(from, to); err != nil {
+		return nil, err
+	}
+	var domains []string
+	rcptsByDomain := make(map[string][]string)
+	for _, rcpt := range to {
+		i := strings.LastIndexByte(rcpt, '@')
+		if i < 0 {
+			return nil, fmt.Errorf("smtp: invalid recipient address %q", rcpt)
+		}
+		domain := strings.ToLower(rcpt[i+1:])
+		if _, ok := rcptsByDomain[domain]; !ok {
+			domains = append(domains, domain)
+		}
+		rcptsByDomain[domain] = append(rcptsByDomain[domain], rcpt)
+	}
+
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	errs := make(map[string]error)
+	for _, domain := range domains {
+		rcpts := rcptsByDomain[domain]
+		for rcpt, err := range sendMailDomain(ctx, domain, from, rcpts, msg) {
+			errs[rcpt] = err
+		}
+	}
+	return errs, nil
+}
+
+// sendMailDomain delivers a message to recipients of a single domain, and
+// returns an error for each recipient the message couldn't be delivered to.
+func sendMailDomain(ctx context.Context, domain, from string, rcpts []string, msg []byte) map[string]error {
+	failAll := func(err error) map[string]error {
+		errs := make(map[string]error, len(rcpts))
+		for _, rcpt := range rcpts {
+			errs[rcpt] = err
+		}
+		return errs
+	}
+
+	hosts, err := lookupMXHosts(ctx, domain)
+	if err != nil {
+		return failAll(err)
+	}
+
+	for _, host := range hosts {
+		var rcptErrs map[string]error
+		rcptErrs, err = sendMailHost(ctx, host, from, rcpts, msg)
+		if err == nil {
+			return rcptErrs
+		}
+		if IsPermanent(err) || ctx.Err() != nil {
+			// Other hosts would reject the message as well
+			break
+		}
+	}
+	return failAll(err)
+}
+
+// lookupMXHosts returns the mail exchangers of a domain, by order of
+// preference.
+func lookupMXHosts(ctx context.Context, domain string) ([]string, error) {
+	mxs, err := lookupMX(ctx, domain)
+	if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+		// No MX record, use the domain itself (RFC 5321 section 5.1)
+		return []string{domain}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if len(mxs) == 0 {
+		return []string{domain}, nil
+	}
+	if len(mxs) == 1 && mxs[0].Host == "." {
+		return nil, fmt.Errorf("smtp: domain %v does not accept mail (null MX)", domain)
+	}
+
+	// LookupMX already sorts records by preference
+	hosts := make([]string, len(mxs))
+	for i, mx := range mxs {
+		hosts[i] = strings.TrimSuffix(mx.Host, ".")
+	}
+	return hosts, nil
+}
+
+// newClientContext is like NewClient, but gives up waiting for the greeting
+// when ctx is done. The connection is closed in that case.
+func newClientContext(ctx context.Context, conn net.Conn, host string) (*Client, error) {
+	if err := ctx.Err(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+
+	c, err := NewClient(conn, host)
+	close(stop)
+	if <-interrupted {
+		if c != nil {
+			c.Close()
+		}
+		return nil, ctx.Err()
+	}
+	return c, err
+}
+
+// sendMailHost delivers a message to a single host. If the transaction fails,
+// an error is returned. Otherwise, an error is returned for each recipient
+// rejected by the server.
+func sendMailHost(ctx context.Context, host, from string, rcpts []string, msg []byte) (map[string]error, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(host, mxPort))
+	if err != nil {
+		return nil, err
+	}
+	c, err := newClientContext(ctx, conn, host)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	// Servers often reject clients introducing themselves as "localhost"
+	c.SetLocalNameFromOS()
+
+	if err := c.HelloContext(ctx, c.localName); err != nil {
+		return nil, err
+	}
+	config := &tls.Config{ServerName: host, InsecureSkipVerify: true}
+	if _, err := c.StartTLSOpportunisticContext(ctx, config); err != nil {
+		return nil, err
+	}
+
+	if err := c.MailContext(ctx, from, nil); err != nil {
+		return nil, err
+	}
+	rcptErrs := make(map[string]error)
+	for _, rcpt := range rcpts {
+		if err := c.RcptContext(ctx, rcpt, nil); err != nil {
+			if _, ok := err.(*SMTPError); !ok {
+				return nil, err
+			}
+			rcptErrs[rcpt] = err
+		}
+	}
+	if len(rcptErrs) == len(rcpts) {
+		c.QuitContext(ctx)
+		return rcptErrs, nil
+	}
+
+	w, err := c.DataContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	c.QuitContext(ctx)
+	return rcptErrs, nil
 }
 
 // Extension reports whether an extension is support by the server.
@@ -584,7 +2855,7 @@ func SendMail(addr string, a sasl.Client, from string, to []string, r io.Reader)
 // Extension also returns a string that contains any parameters the
 // server specifies for the extension.
 func (c *Client) Extension(ext string) (bool, string) {
-	if err := c.hello(); err != nil {
+	if err := c.withContext(context.Background(), c.hello); err != nil {
 		return false, ""
 	}
 	if c.ext == nil {
@@ -595,44 +2866,160 @@ func (c *Client) Extension(ext string) (bool, string) {
 	return ok, param
 }
 
-// Reset sends the RSET command to the server, aborting the current mail
-// transaction.
-func (c *Client) Reset() error {
-	if err := c.hello(); err != nil {
-		return err
+// Extensions returns all the extensions advertised by the server in its last
+// EHLO response, keyed by upper-case extension name. Values contain the
+// parameters the server specifies for each extension, if any.
+//
+// The returned map is a copy and can be freely modified by the caller.
+func (c *Client) Extensions() map[string]string {
+	if err := c.withContext(context.Background(), c.hello); err != nil {
+		return nil
 	}
-	if _, _, err := c.cmd(250, "RSET"); err != nil {
-		return err
+	ext := make(map[string]string, len(c.ext))
+	for name, param := range c.ext {
+		ext[name] = param
 	}
-	c.rcpts = nil
-	return nil
+	return ext
+}
+
+// AuthMechanisms returns the SASL mechanisms advertised by the server in its
+// last EHLO response.
+func (c *Client) AuthMechanisms() []string {
+	if err := c.withContext(context.Background(), c.hello); err != nil {
+		return nil
+	}
+	return append([]string(nil), c.auth...)
+}
+
+// MaxMessageSize returns the maximum message size in bytes advertised by the
+// server with the SIZE extension (RFC 1870). ok is false if the server doesn't
+// support SIZE. If it does but has no fixed limit ("SIZE" or "SIZE 0"), size
+// is zero.
+func (c *Client) MaxMessageSize() (size int, ok bool) {
+	if err := c.withContext(context.Background(), c.hello); err != nil {
+		return 0, false
+	}
+	return c.maxMessageSize()
+}
+
+func (c *Client) maxMessageSize() (size int, ok bool) {
+	param, ok := c.ext["SIZE"]
+	if !ok {
+		return 0, false
+	}
+	// A missing, zero or invalid maximum means that the server has no fixed
+	// limit
+	size, err := strconv.Atoi(param)
+	if err != nil || size < 0 {
+		return 0, true
+	}
+	return size, true
+}
+
+// Reset sends the RSET command to the server, aborting the current mail
+// transaction. A new transaction can then be started with Mail on the same
+// connection, e.g. after a recipient has been rejected.
+func (c *Client) Reset() error {
+	return c.ResetContext(context.Background())
+}
+
+// ResetContext is like Reset, but aborts the command when ctx is done.
+func (c *Client) ResetContext(ctx context.Context) error {
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(250, "RSET"); err != nil {
+			return err
+		}
+		c.rcpts = nil
+		c.binarymime = false
+		return nil
+	})
 }
 
 // Noop sends the NOOP command to the server. It does nothing but check
 // that the connection to the server is okay.
 func (c *Client) Noop() error {
-	if err := c.hello(); err != nil {
+	return c.NoopContext(context.Background())
+}
+
+// NoopContext is like Noop, but aborts the command when ctx is done.
+func (c *Client) NoopContext(ctx context.Context) error {
+	return c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		_, _, err := c.cmd(250, "NOOP")
 		return err
-	}
-	_, _, err := c.cmd(250, "NOOP")
-	return err
+	})
+}
+
+// NoopArg is like Noop, but sends arg as the NOOP parameter, as allowed by
+// RFC 5321 section 4.1.1.9. This can be used to embed a probe token in the
+// session. The server ignores the argument, but the text of its reply is
+// returned so that it can be correlated with the probe.
+func (c *Client) NoopArg(arg string) (string, error) {
+	return c.NoopArgContext(context.Background(), arg)
+}
+
+// NoopArgContext is like NoopArg, but aborts the command when ctx is done.
+func (c *Client) NoopArgContext(ctx context.Context, arg string) (string, error) {
+	if err := validateLine(arg); err != nil {
+		return "", err
+	}
+	var msg string
+	err := c.withContext(ctx, func() error {
+		if err := c.hello(); err != nil {
+			return err
+		}
+		var err error
+		_, msg, err = c.cmd(250, "NOOP %s", arg)
+		return err
+	})
+	return msg, err
 }
 
 // Quit sends the QUIT command and closes the connection to the server.
 //
+// QUIT is sent even if a previous command failed, unless the connection is
+// unusable or a message transfer is in progress.
+//
 // If Quit fails the connection is not closed, Close should be used
 // in this case.
 func (c *Client) Quit() error {
-	if err := c.hello(); err != nil {
-		return err
+	return c.QuitContext(context.Background())
+}
+
+// QuitContext is like Quit, but aborts the command when ctx is done.
+func (c *Client) QuitContext(ctx context.Context) error {
+	c.mu.Lock()
+	_, closed := c.err.(*ConnectionClosedError)
+	c.mu.Unlock()
+	if closed {
+		// The server has already said goodbye
+		return c.Close()
 	}
-	_, _, err := c.cmd(221, "QUIT")
+
+	err := c.withContext(ctx, func() error {
+		if c.inData {
+			// QUIT would be sent as part of the message
+			return errors.New("smtp: Quit called during a message transfer")
+		}
+		// Say goodbye even if the server rejected the greeting
+		c.hello()
+		_, _, err := c.cmd(221, "QUIT")
+		return err
+	})
 	if err != nil {
 		return err
 	}
-	return c.Text.Close()
+	return c.Close()
 }
 
+// parseEnhancedCode parses an enhanced status code, as defined in RFC 3463
+// section 2: "class.subject.detail", where class is 2, 4 or 5 and subject and
+// detail are numbers of at most 3 digits.
 func parseEnhancedCode(s string) (EnhancedCode, error) {
 	parts := strings.Split(s, ".")
 	if len(parts) != 3 {
@@ -641,15 +3028,34 @@ func parseEnhancedCode(s string) (EnhancedCode, error) {
 
 	code := EnhancedCode{}
 	for i, part := range parts {
+		if len(part) == 0 || len(part) > 3 || strings.Trim(part, "0123456789") != "" {
+			return code, fmt.Errorf("invalid enhanced code part %q", part)
+		}
 		num, err := strconv.Atoi(part)
 		if err != nil {
 			return code, err
 		}
 		code[i] = num
 	}
+	if code[0] != 2 && code[0] != 4 && code[0] != 5 {
+		return code, fmt.Errorf("invalid enhanced code class %v", code[0])
+	}
 	return code, nil
 }
 
+// trimEnhancedCode removes the enhanced status code prepended to a reply line,
+// if any.
+func trimEnhancedCode(line string) string {
+	parts := strings.SplitN(line, " ", 2)
+	if len(parts) != 2 {
+		return line
+	}
+	if _, err := parseEnhancedCode(parts[0]); err != nil {
+		return line
+	}
+	return parts[1]
+}
+
 // toSMTPErr converts textproto.Error into SMTPError, parsing
 // enhanced status code if it is present.
 func toSMTPErr(protoErr *textproto.Error) *SMTPError {
@@ -667,7 +3073,7 @@ func toSMTPErr(protoErr *textproto.Error) *SMTPError {
 	}
 
 	enchCode, err := parseEnhancedCode(parts[0])
-	if err != nil {
+	if err != nil || enchCode[0] != protoErr.Code/100 {
 		return smtpErr
 	}
 
@@ -1,12 +1,16 @@
 package smtp
 
 import (
+	"bytes"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/textproto"
 	"regexp"
@@ -15,6 +19,7 @@ import (
 	"strings"
 	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // Number of errors we'll tolerate per connection before closing. Defaults to 3.
@@ -24,7 +29,29 @@ type ConnectionState struct {
 	Hostname   string
 	LocalAddr  net.Addr
 	RemoteAddr net.Addr
-	TLS        tls.ConnectionState
+
+	// State of the TLS connection, zero if the connection doesn't use TLS.
+	// TLS.ServerName contains the host name requested by the client via SNI,
+	// if any.
+	TLS tls.ConnectionState
+
+	// Attributes of the original client asserted by a trusted relay with the
+	// XCLIENT command, nil if none. RemoteAddr is updated accordingly.
+	XClient *XClient
+
+	// Unique ID of the connection, see Conn.SessionID.
+	SessionID string
+}
+
+// XClient contains the attributes of the original client, as asserted by a
+// trusted relay with the XCLIENT command. Unavailable attributes are empty.
+type XClient struct {
+	// Host name of the client, as found in the DNS.
+	Name string
+	// Login name the client authenticated with.
+	Login string
+	// Protocol used by the client, SMTP or ESMTP.
+	Proto string
 }
 
 type Conn struct {
@@ -32,6 +59,8 @@ type Conn struct {
 	text   *textproto.Conn
 	server *Server
 	helo   string
+	ehlo   bool // whether the client greeted with EHLO or LHLO
+	id     string
 
 	// Number of errors witnessed on this connection
 	errCount int
@@ -39,22 +68,44 @@ type Conn struct {
 	session    Session
 	locker     sync.Mutex
 	binarymime bool
+	// Whether replies include enhanced status codes
+	enhancedCodes bool
+	utf8          bool // whether SMTPUTF8 was passed to MAIL
 
 	lineLimitReader *lineLimitReader
 	bdatPipe        *io.PipeWriter
 	bdatStatus      *statusCollector // used for BDAT on LMTP
 	dataResult      chan error
-	bytesReceived   int // counts total size of chunks when BDAT is used
+	bdatQueueID     string // set before the result is sent to dataResult
+	bytesReceived   int    // counts total size of chunks when BDAT is used
 
 	fromReceived bool
 	recipients   []string
 	didAuth      bool
+	authUser     string // identity set by the SASL mechanism
+
+	// Time of the last command other than NOOP, for Server.IdleTimeout
+	lastActivity time.Time
+
+	// Original addresses of the connection, if sent in a PROXY protocol
+	// header
+	proxySrc, proxyDst net.Addr
+
+	xclient     *XClient
+	xclientAddr net.Addr
+
+	// Whether the command being handled may be followed by other commands in
+	// the same pipelined group (RFC 2920 section 3.1)
+	pipelined bool
+	// Command being handled, for logging
+	cmd string
 }
 
 func newConn(c net.Conn, s *Server) *Conn {
 	sc := &Conn{
 		server: s,
 		conn:   c,
+		id:     newSessionID(),
 	}
 
 	sc.init()
@@ -82,8 +133,8 @@ func (c *Conn) init() {
 			io.Writer
 			io.Closer
 		}{
-			io.TeeReader(rwc.Reader, c.server.Debug),
-			io.MultiWriter(rwc.Writer, c.server.Debug),
+			io.TeeReader(rwc.Reader, &debugWriter{w: c.server.Debug, prefix: c.id + " C: "}),
+			io.MultiWriter(rwc.Writer, &debugWriter{w: c.server.Debug, prefix: c.id + " S: "}),
 			rwc.Closer,
 		}
 	}
@@ -95,13 +146,16 @@ func (c *Conn) init() {
 func (c *Conn) handle(cmd string, arg string) {
 	// If panic happens during command handling - send 421 response
 	// and close connection.
+	c.cmd = cmd
 	defer func() {
+		c.pipelined = false
+		c.cmd = ""
+
 		if err := recover(); err != nil {
 			c.WriteResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
-			c.Close()
+			c.close(fmt.Errorf("smtp: panic: %v", err))
 
-			stack := debug.Stack()
-			c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
+			c.logError("panic serving connection", "command", cmd, "error", err, "stack", string(debug.Stack()))
 		}
 	}()
 
@@ -112,9 +166,22 @@ func (c *Conn) handle(cmd string, arg string) {
 
 	cmd = strings.ToUpper(cmd)
 	switch cmd {
-	case "SEND", "SOML", "SAML", "EXPN", "HELP", "TURN":
+	case "MAIL", "RCPT", "RSET", "SEND", "SOML", "SAML", "BDAT":
+		c.pipelined = true
+	}
+
+	if c.server.commandDisabled(cmd) {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command disabled", cmd))
+		return
+	}
+
+	if unimplementedCommands[cmd] {
 		// These commands are not implemented in any state
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, fmt.Sprintf("%v command not implemented", cmd))
+		return
+	}
+
+	switch cmd {
 	case "HELO", "EHLO", "LHLO":
 		lmtp := cmd == "LHLO"
 		enhanced := lmtp || cmd == "EHLO"
@@ -132,7 +199,11 @@ func (c *Conn) handle(cmd string, arg string) {
 	case "RCPT":
 		c.handleRcpt(arg)
 	case "VRFY":
-		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		c.handleVrfy(arg)
+	case "EXPN":
+		c.handleExpn(arg)
+	case "HELP":
+		c.handleHelp()
 	case "NOOP":
 		c.WriteResponse(250, EnhancedCode{2, 0, 0}, "I have sucessfully done nothing")
 	case "RSET": // Reset session
@@ -144,7 +215,7 @@ func (c *Conn) handle(cmd string, arg string) {
 		c.handleData(arg)
 	case "QUIT":
 		c.WriteResponse(221, EnhancedCode{2, 0, 0}, "Bye")
-		c.Close()
+		c.close(nil)
 	case "AUTH":
 		if c.server.AuthDisabled {
 			c.protocolError(500, EnhancedCode{5, 5, 2}, "Syntax error, AUTH command unrecognized")
@@ -153,6 +224,8 @@ func (c *Conn) handle(cmd string, arg string) {
 		}
 	case "STARTTLS":
 		c.handleStartTLS()
+	case "XCLIENT":
+		c.handleXClient(arg)
 	default:
 		msg := fmt.Sprintf("Syntax errors, %v command unrecognized", cmd)
 		c.protocolError(500, EnhancedCode{5, 5, 2}, msg)
@@ -176,7 +249,22 @@ func (c *Conn) SetSession(session Session) {
 	c.session = session
 }
 
+// Reasons passed to LogoutReasonSession.
+var (
+	errConnClosed     = errors.New("smtp: connection closed by the server")
+	errTooManyErrors  = errors.New("smtp: too many errors")
+	errServerShutdown = errors.New("smtp: server shutting down")
+	errTooBusy        = errors.New("smtp: server too busy")
+	errEarlyTalker    = errors.New("smtp: client sent data before the greeting")
+)
+
 func (c *Conn) Close() error {
+	return c.close(errConnClosed)
+}
+
+// close closes the connection. reason is passed to the session, nil means the
+// client quit.
+func (c *Conn) close(reason error) error {
 	c.locker.Lock()
 	defer c.locker.Unlock()
 
@@ -186,15 +274,34 @@ func (c *Conn) Close() error {
 	}
 
 	if c.session != nil {
-		c.session.Logout()
+		c.logout(c.session, reason)
 		c.session = nil
 	}
 
 	return c.conn.Close()
 }
 
+// logout logs out the session. Panics are recovered, since logout may be
+// called while handling another panic.
+func (c *Conn) logout(session Session, reason error) {
+	defer func() {
+		if err := recover(); err != nil {
+			c.logError("panic serving connection", "error", err, "stack", string(debug.Stack()))
+		}
+	}()
+
+	if s, ok := session.(LogoutReasonSession); ok {
+		s.LogoutWithReason(reason)
+	} else {
+		session.Logout()
+	}
+}
+
 // TLSConnectionState returns the connection's TLS connection state.
 // Zero values are returned if the connection doesn't use TLS.
+//
+// The host name requested by the client via SNI is available in
+// state.ServerName.
 func (c *Conn) TLSConnectionState() (state tls.ConnectionState, ok bool) {
 	tc, ok := c.conn.(*tls.Conn)
 	if !ok {
@@ -211,12 +318,67 @@ func (c *Conn) State() ConnectionState {
 	}
 
 	state.Hostname = c.helo
+	state.SessionID = c.id
 	state.LocalAddr = c.conn.LocalAddr()
-	state.RemoteAddr = c.conn.RemoteAddr()
+	state.RemoteAddr = c.peerAddr()
+	if c.proxySrc != nil {
+		state.LocalAddr = c.proxyDst
+	}
+	if c.xclient != nil {
+		xclient := *c.xclient
+		state.XClient = &xclient
+		if c.xclientAddr != nil {
+			state.RemoteAddr = c.xclientAddr
+		}
+	}
 
 	return state
 }
 
+// SessionID returns a unique ID for the connection. It is included in the
+// Debug output and in the logs, and can be used by backends to correlate
+// their own records with the connection.
+func (c *Conn) SessionID() string {
+	return c.id
+}
+
+// peerAddr returns the address of the peer, ignoring XCLIENT.
+func (c *Conn) peerAddr() net.Addr {
+	if c.proxySrc != nil {
+		return c.proxySrc
+	}
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) xclientAllowed() bool {
+	addr, ok := c.peerAddr().(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range c.server.TrustedXClientNets {
+		if n.Contains(addr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthenticatedUser returns the identity of the client, as established by a
+// successful AUTH command, e.g. so that backends can check that the sender
+// address belongs to the logged-in user. ok is false if the client isn't
+// authenticated.
+func (c *Conn) AuthenticatedUser() (user string, ok bool) {
+	return c.authUser, c.didAuth
+}
+
+// SetAuthenticatedUser sets the identity returned by AuthenticatedUser. It
+// should be called by the SASL mechanisms registered with Server.EnableAuth
+// with the authorization identity, once the client is authenticated. The
+// built-in PLAIN and LOGIN mechanisms call it.
+func (c *Conn) SetAuthenticatedUser(user string) {
+	c.authUser = user
+}
+
 func (c *Conn) authAllowed() bool {
 	_, isTLS := c.TLSConnectionState()
 	return !c.server.AuthDisabled && (isTLS || c.server.AllowInsecureAuth)
@@ -227,26 +389,47 @@ func (c *Conn) authAllowed() bool {
 func (c *Conn) protocolError(code int, ec EnhancedCode, msg string) {
 	c.WriteResponse(code, ec, msg)
 
+	if c.server.Logger != nil {
+		c.server.Logger.Warn("protocol error", c.logArgs("command", c.cmd, "code", code, "message", msg)...)
+	}
+
 	c.errCount++
 	if c.errCount > errThreshold {
+		c.pipelined = false
 		c.WriteResponse(500, EnhancedCode{5, 5, 1}, "Too many errors. Quiting now")
-		c.Close()
+		c.close(errTooManyErrors)
 	}
 }
 
 // GREET state -> waiting for HELO
 func (c *Conn) handleGreet(enhanced bool, arg string) {
+	if c.server.shuttingDown() {
+		c.WriteResponse(421, EnhancedCode{4, 3, 2}, "Server shutting down")
+		c.close(errServerShutdown)
+		return
+	}
+
 	domain, err := parseHelloArgument(arg)
 	if err != nil {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Domain/address argument required for HELO")
 		return
 	}
 	c.helo = domain
+	c.ehlo = enhanced
 
-	sess, err := c.server.Backend.NewSession(c.State(), domain)
+	var sess Session
+	if be, ok := c.server.Backend.(ConnBackend); ok {
+		sess, err = be.NewConnSession(c)
+	} else {
+		sess, err = c.server.Backend.NewSession(c.State(), domain)
+	}
 	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			if smtpErr.Code == 421 || smtpErr.Code == 554 {
+				// The backend refuses to serve this client at all
+				c.close(err)
+			}
 			return
 		}
 		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
@@ -254,19 +437,28 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	}
 	c.SetSession(sess)
 
+	c.enhancedCodes = enhanced && c.server.EnableEnhancedStatusCodes
 	if !enhanced {
-		c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Hello %s", domain))
+		c.WriteResponse(250, EnhancedCode{2, 0, 0}, c.helloReply(domain))
 		return
 	}
 
 	caps := []string{}
-	caps = append(caps, c.server.caps...)
-	if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS {
+	for _, name := range c.server.caps {
+		if name == "CHUNKING" && !c.server.chunking() {
+			continue
+		}
+		caps = append(caps, name)
+	}
+	if c.server.EnableEnhancedStatusCodes {
+		caps = append(caps, "ENHANCEDSTATUSCODES")
+	}
+	if _, isTLS := c.TLSConnectionState(); c.server.TLSConfig != nil && !isTLS && !c.server.commandDisabled("STARTTLS") {
 		caps = append(caps, "STARTTLS")
 	}
-	if c.authAllowed() {
+	if c.authAllowed() && len(c.server.authMechs) > 0 && !c.server.commandDisabled("AUTH") {
 		authCap := "AUTH"
-		for name := range c.server.auths {
+		for _, name := range c.server.authMechs {
 			authCap += " " + name
 		}
 
@@ -278,16 +470,22 @@ func (c *Conn) handleGreet(enhanced bool, arg string) {
 	if _, isTLS := c.TLSConnectionState(); isTLS && c.server.EnableREQUIRETLS {
 		caps = append(caps, "REQUIRETLS")
 	}
-	if c.server.EnableBINARYMIME {
+	if c.server.EnableBINARYMIME && c.server.chunking() {
 		caps = append(caps, "BINARYMIME")
 	}
+	if c.server.EnableDSN {
+		caps = append(caps, "DSN")
+	}
+	if c.xclientAllowed() && !c.server.commandDisabled("XCLIENT") {
+		caps = append(caps, "XCLIENT NAME ADDR PORT PROTO LOGIN")
+	}
 	if c.server.MaxMessageBytes > 0 {
 		caps = append(caps, fmt.Sprintf("SIZE %v", c.server.MaxMessageBytes))
 	} else {
 		caps = append(caps, "SIZE")
 	}
 
-	args := []string{"Hello " + domain}
+	args := []string{c.helloReply(domain)}
 	args = append(args, caps...)
 	c.WriteResponse(250, NoEnhancedCode, args...)
 }
@@ -298,10 +496,19 @@ func (c *Conn) handleMail(arg string) {
 		c.WriteResponse(502, EnhancedCode{2, 5, 1}, "Please introduce yourself first.")
 		return
 	}
+	if c.server.shuttingDown() {
+		c.WriteResponse(421, EnhancedCode{4, 3, 2}, "Server shutting down")
+		c.close(errServerShutdown)
+		return
+	}
 	if c.bdatPipe != nil {
 		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "MAIL not allowed during message transfer")
 		return
 	}
+	if _, isTLS := c.TLSConnectionState(); !isTLS && c.server.RequireTLSForMail {
+		c.WriteResponse(530, EnhancedCode{5, 7, 0}, "Must issue a STARTTLS command first")
+		return
+	}
 
 	if len(arg) < 6 || strings.ToUpper(arg[0:5]) != "FROM:" {
 		c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Was expecting MAIL arg syntax of FROM:<address>")
@@ -320,6 +527,10 @@ func (c *Conn) handleMail(arg string) {
 		return
 	}
 	from = strings.Trim(from, "<>")
+	if err := ValidateAddress(from); err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 1, 7}, "Invalid sender address")
+		return
+	}
 
 	opts := &MailOptions{}
 
@@ -337,13 +548,19 @@ func (c *Conn) handleMail(arg string) {
 			switch key {
 			case "SIZE":
 				size, err := strconv.ParseInt(value, 10, 32)
-				if err != nil {
+				if numErr, ok := err.(*strconv.NumError); ok && numErr.Err == strconv.ErrRange && size > 0 {
+					// Larger than we're ever willing to accept
+					size = math.MaxInt64
+				} else if err != nil || size < 0 {
 					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse SIZE as an integer")
 					return
 				}
 
-				if c.server.MaxMessageBytes > 0 && int(size) > c.server.MaxMessageBytes {
-					c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
+				// Reject the message before it's transferred if it can't
+				// be accepted, as described in RFC 1870 section 6.1
+				maxBytes := c.maxMessageBytes()
+				if size > math.MaxInt32 || (maxBytes > 0 && size > int64(maxBytes)) {
+					c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Message size exceeds fixed maximum message size")
 					return
 				}
 
@@ -359,18 +576,27 @@ func (c *Conn) handleMail(arg string) {
 					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "REQUIRETLS is not implemented")
 					return
 				}
+				if _, isTLS := c.TLSConnectionState(); !isTLS {
+					c.WriteResponse(530, EnhancedCode{5, 7, 0}, "Must issue a STARTTLS command first")
+					return
+				}
 				opts.RequireTLS = true
 			case "BODY":
+				value = strings.ToUpper(value)
 				switch value {
 				case "BINARYMIME":
 					if !c.server.EnableBINARYMIME {
 						c.WriteResponse(504, EnhancedCode{5, 5, 4}, "BINARYMIME is not implemented")
 						return
 					}
+					if !c.server.chunking() {
+						c.WriteResponse(501, EnhancedCode{5, 5, 4}, "BODY=BINARYMIME requires CHUNKING")
+						return
+					}
 					c.binarymime = true
 				case "7BIT", "8BITMIME":
 				default:
-					c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown BODY value")
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown BODY value")
 					return
 				}
 				opts.Body = BodyType(value)
@@ -390,6 +616,29 @@ func (c *Conn) handleMail(arg string) {
 				}
 				decodedMbox := value[1 : len(value)-1]
 				opts.Auth = &decodedMbox
+			case "RET":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN not supported")
+					return
+				}
+				switch ret := DSNReturn(strings.ToUpper(value)); ret {
+				case DSNReturnFull, DSNReturnHeaders:
+					opts.Ret = ret
+				default:
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unknown RET value")
+					return
+				}
+			case "ENVID":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN not supported")
+					return
+				}
+				value, err := decodeXtext(value)
+				if err != nil || value == "" {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ENVID parameter value")
+					return
+				}
+				opts.EnvelopeID = value
 			default:
 				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown MAIL FROM argument")
 				return
@@ -397,6 +646,16 @@ func (c *Conn) handleMail(arg string) {
 		}
 	}
 
+	if !opts.UTF8 && !isASCII(from) {
+		c.WriteResponse(550, EnhancedCode{5, 6, 7}, "Mailbox name not allowed (SMTPUTF8 required)")
+		return
+	}
+
+	if c.server.RequireValidSenderDomain && !senderDomainResolves(c.server.resolver(), from) {
+		c.WriteResponse(450, EnhancedCode{4, 1, 8}, "Sender domain does not resolve")
+		return
+	}
+
 	if err := c.Session().Mail(from, opts); err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
@@ -408,6 +667,7 @@ func (c *Conn) handleMail(arg string) {
 
 	c.WriteResponse(250, EnhancedCode{2, 0, 0}, fmt.Sprintf("Roger, accepting mail from <%v>", from))
 	c.fromReceived = true
+	c.utf8 = opts.UTF8
 }
 
 // This regexp matches 'hexchar' token defined in
@@ -442,21 +702,48 @@ func decodeXtext(val string) (string, error) {
 	return decoded, nil
 }
 
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDSNNotify parses the value of the NOTIFY= argument, as defined in
+// RFC 3461 section 4.1.
+func parseDSNNotify(value string) ([]DSNNotify, error) {
+	l := strings.Split(strings.ToUpper(value), ",")
+	notify := make([]DSNNotify, 0, len(l))
+	for _, s := range l {
+		switch n := DSNNotify(s); n {
+		case DSNNotifyNever:
+			if len(l) != 1 {
+				return nil, errors.New("NOTIFY=NEVER cannot be combined with other values")
+			}
+			notify = append(notify, n)
+		case DSNNotifySuccess, DSNNotifyFailure, DSNNotifyDelay:
+			notify = append(notify, n)
+		default:
+			return nil, fmt.Errorf("unknown NOTIFY value %q", s)
+		}
+	}
+	return notify, nil
+}
+
 func encodeXtext(raw string) string {
 	var out strings.Builder
 	out.Grow(len(raw))
 
-	for _, ch := range raw {
-		if ch == '+' || ch == '=' {
-			out.WriteRune('+')
-			out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
-		}
-		if ch > '!' && ch < '~' { // printable non-space US-ASCII
-			out.WriteRune(ch)
+	for i := 0; i < len(raw); i++ {
+		ch := raw[i]
+		if ch >= '!' && ch <= '~' && ch != '+' && ch != '=' {
+			// printable non-space US-ASCII
+			out.WriteByte(ch)
+			continue
 		}
-		// Non-ASCII.
-		out.WriteRune('+')
-		out.WriteString(strings.ToUpper(strconv.FormatInt(int64(ch), 16)))
+		fmt.Fprintf(&out, "+%02X", ch)
 	}
 	return out.String()
 }
@@ -477,15 +764,78 @@ func (c *Conn) handleRcpt(arg string) {
 		return
 	}
 
+	toArgs := strings.Split(strings.Trim(arg[3:], " "), " ")
 	// TODO: This trim is probably too forgiving
-	recipient := strings.Trim(arg[3:], "<> ")
+	recipient := strings.Trim(toArgs[0], "<> ")
+	if err := ValidateAddress(recipient); err != nil {
+		c.WriteResponse(501, EnhancedCode{5, 1, 3}, "Invalid recipient address")
+		return
+	}
+
+	if !c.utf8 && !isASCII(recipient) {
+		c.WriteResponse(550, EnhancedCode{5, 6, 7}, "Mailbox name not allowed (SMTPUTF8 required)")
+		return
+	}
+
+	opts := &RcptOptions{}
+	if len(toArgs) > 1 {
+		args, err := parseArgs(toArgs[1:])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unable to parse RCPT ESMTP parameters")
+			return
+		}
+
+		for key, value := range args {
+			switch key {
+			case "NOTIFY":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN not supported")
+					return
+				}
+				notify, err := parseDSNNotify(value)
+				if err != nil {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed NOTIFY parameter value")
+					return
+				}
+				opts.Notify = notify
+			case "ORCPT":
+				if !c.server.EnableDSN {
+					c.WriteResponse(504, EnhancedCode{5, 5, 4}, "DSN not supported")
+					return
+				}
+				parts := strings.SplitN(value, ";", 2)
+				if len(parts) != 2 || !strings.EqualFold(parts[0], "rfc822") {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Unsupported ORCPT address type")
+					return
+				}
+				origRcpt, err := decodeXtext(parts[1])
+				if err != nil || origRcpt == "" {
+					c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed ORCPT parameter value")
+					return
+				}
+				opts.OrigRcpt = origRcpt
+			default:
+				c.WriteResponse(500, EnhancedCode{5, 5, 4}, "Unknown RCPT TO argument")
+				return
+			}
+		}
+	}
 
 	if c.server.MaxRecipients > 0 && len(c.recipients) >= c.server.MaxRecipients {
-		c.WriteResponse(552, EnhancedCode{5, 5, 3}, fmt.Sprintf("Maximum limit of %v recipients reached", c.server.MaxRecipients))
+		// 452 lets the client send the message to the accepted recipients
+		// and retry the others later (RFC 5321 section 4.5.3.1.10)
+		c.WriteResponse(452, EnhancedCode{4, 5, 3}, fmt.Sprintf("Too many recipients, maximum is %v", c.server.MaxRecipients))
 		return
 	}
+	opts.Count = len(c.recipients)
 
-	if err := c.Session().Rcpt(recipient); err != nil {
+	var err error
+	if sess, ok := c.Session().(RcptOptionsSession); ok {
+		err = sess.RcptWithOptions(recipient, opts)
+	} else {
+		err = c.Session().Rcpt(recipient)
+	}
+	if err != nil {
 		if smtpErr, ok := err.(*SMTPError); ok {
 			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
 			return
@@ -506,27 +856,40 @@ func (c *Conn) handleAuth(arg string) {
 		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "Already authenticated")
 		return
 	}
+	defer func() {
+		// The mechanism may have set an identity before failing
+		if !c.didAuth {
+			c.authUser = ""
+		}
+	}()
 
 	parts := strings.Fields(arg)
 	if len(parts) == 0 {
-		c.WriteResponse(502, EnhancedCode{5, 5, 4}, "Missing parameter")
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Missing parameter")
 		return
 	}
 
 	if _, isTLS := c.TLSConnectionState(); !isTLS && !c.server.AllowInsecureAuth {
-		c.WriteResponse(523, EnhancedCode{5, 7, 10}, "TLS is required")
+		c.WriteResponse(538, EnhancedCode{5, 7, 11}, "Encryption required for requested authentication mechanism")
 		return
 	}
 
 	mechanism := strings.ToUpper(parts[0])
 
-	// Parse client initial response if there is one
+	// Parse client initial response if there is one. A single "=" is an
+	// empty initial response, as opposed to no initial response at all
+	// (RFC 4954 section 4).
 	var ir []byte
 	if len(parts) > 1 {
-		var err error
-		ir, err = base64.StdEncoding.DecodeString(parts[1])
-		if err != nil {
-			return
+		if parts[1] == "=" {
+			ir = []byte{}
+		} else {
+			var err error
+			ir, err = base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Invalid base64 data")
+				return
+			}
 		}
 	}
 
@@ -573,7 +936,7 @@ func (c *Conn) handleAuth(arg string) {
 
 		response, err = base64.StdEncoding.DecodeString(encoded)
 		if err != nil {
-			c.WriteResponse(454, EnhancedCode{4, 7, 0}, "Invalid base64 data")
+			c.WriteResponse(501, EnhancedCode{5, 5, 2}, "Invalid base64 data")
 			return
 		}
 	}
@@ -593,13 +956,25 @@ func (c *Conn) handleStartTLS() {
 		return
 	}
 
+	// Anything the client sent after STARTTLS was received in cleartext and
+	// could have been injected by an attacker (CVE-2011-0411). Discard it
+	// before the handshake, so that only encrypted input is processed
+	// afterwards. This also ensures the reply below isn't held back as part
+	// of a pipelined group.
+	if n := c.text.R.Buffered(); n > 0 {
+		c.text.R.Discard(n)
+		if c.server.Logger != nil {
+			c.server.Logger.Warn("discarded data pipelined after STARTTLS", c.logArgs("bytes", n)...)
+		}
+	}
+
 	c.WriteResponse(220, EnhancedCode{2, 0, 0}, "Ready to start TLS")
 
 	// Upgrade to TLS
-	tlsConn := tls.Server(c.conn, c.server.TLSConfig)
+	tlsConn := tls.Server(c.conn, c.server.tlsConfig())
 
 	if err := tlsConn.Handshake(); err != nil {
-		c.server.ErrorLog.Printf("TLS handshake error for %s: %v", c.conn.RemoteAddr(), err)
+		c.logError("TLS handshake error", "error", err)
 		c.WriteResponse(550, EnhancedCode{5, 0, 0}, "Handshake error")
 		return
 	}
@@ -612,11 +987,178 @@ func (c *Conn) handleStartTLS() {
 	// be able to see the information about TLS connection in the
 	// ConnectionState object passed to it.
 	if session := c.Session(); session != nil {
-		session.Logout()
+		c.logout(session, nil)
 		c.SetSession(nil)
 	}
 	c.didAuth = false
+	c.authUser = ""
+	c.reset()
+}
+
+// maxMessageBytes returns the message size limit of the current session.
+func (c *Conn) maxMessageBytes() int {
+	if sess, ok := c.Session().(MessageSizeSession); ok {
+		return sess.MaxMessageBytes()
+	}
+	return c.server.MaxMessageBytes
+}
+
+func (c *Conn) handleHelp() {
+	text := strings.TrimRight(c.server.HelpText, "\n")
+	if text == "" {
+		c.WriteResponse(502, EnhancedCode{5, 5, 1}, "HELP command not implemented")
+		return
+	}
+
+	c.WriteResponse(214, EnhancedCode{2, 0, 0}, strings.Split(text, "\n")...)
+}
+
+func (c *Conn) handleVrfy(arg string) {
+	sess, ok := c.Session().(VerifySession)
+	if !ok {
+		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot VRFY user, but will accept message")
+		return
+	}
+
+	addr := strings.Trim(arg, "<>")
+	if addr == "" || ValidateAddress(addr) != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting VRFY arg syntax of <address>")
+		return
+	}
+
+	if err := sess.Verify(addr); err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		return
+	}
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, fmt.Sprintf("<%v>", addr))
+}
+
+func (c *Conn) handleExpn(arg string) {
+	sess, ok := c.Session().(ExpandSession)
+	if !ok {
+		c.WriteResponse(252, EnhancedCode{2, 5, 0}, "Cannot EXPN list, but will accept message")
+		return
+	}
+
+	if arg == "" || ValidateAddress(arg) != nil {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting EXPN arg syntax of <list>")
+		return
+	}
+
+	members, err := sess.Expand(arg)
+	if err != nil {
+		if smtpErr, ok := err.(*SMTPError); ok {
+			c.WriteResponse(smtpErr.Code, smtpErr.EnhancedCode, smtpErr.Message)
+			return
+		}
+		c.WriteResponse(451, EnhancedCode{4, 0, 0}, err.Error())
+		return
+	}
+	if len(members) == 0 {
+		c.WriteResponse(550, EnhancedCode{5, 1, 1}, "Mailing list is empty")
+		return
+	}
+	lines := make([]string, len(members))
+	for i, member := range members {
+		lines[i] = fmt.Sprintf("<%v>", member)
+	}
+	c.WriteResponse(250, EnhancedCode{2, 1, 5}, lines...)
+}
+
+// XCLIENT, as defined in https://www.postfix.org/XCLIENT_README.html
+func (c *Conn) handleXClient(arg string) {
+	if !c.xclientAllowed() {
+		c.WriteResponse(550, EnhancedCode{5, 7, 0}, "Not authorized to use XCLIENT")
+		return
+	}
+	if c.fromReceived || c.bdatPipe != nil {
+		c.WriteResponse(503, EnhancedCode{5, 5, 1}, "XCLIENT not allowed during mail transaction")
+		return
+	}
+
+	xclient := XClient{}
+	if c.xclient != nil {
+		xclient = *c.xclient
+	}
+	var ip net.IP
+	var port int
+	if addr, ok := c.xclientAddr.(*net.TCPAddr); ok {
+		ip, port = addr.IP, addr.Port
+	}
+
+	attrs := strings.Fields(arg)
+	if len(attrs) == 0 {
+		c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting XCLIENT arg syntax of attribute=value")
+		return
+	}
+	for _, attr := range attrs {
+		parts := strings.SplitN(attr, "=", 2)
+		if len(parts) != 2 {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Was expecting XCLIENT arg syntax of attribute=value")
+			return
+		}
+		name := strings.ToUpper(parts[0])
+		value, err := decodeXtext(parts[1])
+		if err != nil {
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, fmt.Sprintf("Malformed XCLIENT %v value", name))
+			return
+		}
+		if value == "[UNAVAILABLE]" || value == "[TEMPUNAVAIL]" {
+			value = ""
+		}
+
+		switch name {
+		case "NAME":
+			xclient.Name = value
+		case "LOGIN":
+			xclient.Login = value
+		case "PROTO":
+			xclient.Proto = value
+		case "ADDR":
+			if len(value) > 5 && strings.EqualFold(value[:5], "IPV6:") {
+				value = value[5:]
+			}
+			ip = net.ParseIP(value)
+			if ip == nil && value != "" {
+				c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed XCLIENT ADDR value")
+				return
+			}
+		case "PORT":
+			p, err := strconv.ParseUint(value, 10, 16)
+			if err != nil && value != "" {
+				c.WriteResponse(501, EnhancedCode{5, 5, 4}, "Malformed XCLIENT PORT value")
+				return
+			}
+			port = int(p)
+		default:
+			c.WriteResponse(501, EnhancedCode{5, 5, 4}, fmt.Sprintf("Unsupported XCLIENT attribute %v", name))
+			return
+		}
+	}
+
+	// The session starts over with the new client attributes
 	c.reset()
+	c.locker.Lock()
+	if c.session != nil {
+		c.logout(c.session, nil)
+		c.session = nil
+	}
+	c.locker.Unlock()
+	c.helo = ""
+	c.enhancedCodes = false
+	c.didAuth = false
+	c.authUser = ""
+	c.xclient = &xclient
+	c.xclientAddr = nil
+	if ip != nil {
+		c.xclientAddr = &net.TCPAddr{IP: ip, Port: port}
+	}
+
+	c.greet()
 }
 
 // DATA
@@ -650,10 +1192,28 @@ func (c *Conn) handleData(arg string) {
 	}
 
 	r := newDataReader(c)
-	code, enhancedCode, msg := toSMTPStatus(c.Session().Data(r))
-	r.limited = false
-	io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
-	c.WriteResponse(code, enhancedCode, msg)
+	queueID, err := c.sessionData(r)
+	r.discard() // Make sure all the data has been consumed
+	if r.tooLongLine {
+		// The end of the message can't be found, the connection is closed
+		// by the main loop
+		return
+	}
+	if r.exceeded {
+		// The backend may have ignored the error and processed a truncated
+		// message, reject it anyway
+		err = ErrDataTooLarge
+	}
+	c.WriteResponse(toDataStatus(queueID, err))
+}
+
+// sessionData passes a message to the session, and returns the queue ID
+// assigned by the backend, if any.
+func (c *Conn) sessionData(r io.Reader) (queueID string, err error) {
+	if s, ok := c.Session().(QueueIDSession); ok {
+		return s.DataWithQueueID(r)
+	}
+	return "", c.Session().Data(r)
 }
 
 func (c *Conn) handleBdat(arg string) {
@@ -688,7 +1248,7 @@ func (c *Conn) handleBdat(arg string) {
 		return
 	}
 
-	if c.server.MaxMessageBytes != 0 && c.bytesReceived+int(size) > c.server.MaxMessageBytes {
+	if maxBytes := c.maxMessageBytes(); maxBytes > 0 && c.bytesReceived+int(size) > maxBytes {
 		c.WriteResponse(552, EnhancedCode{5, 3, 4}, "Max message size exceeded")
 
 		// Discard chunk itself without passing it to backend.
@@ -720,7 +1280,7 @@ func (c *Conn) handleBdat(arg string) {
 
 			var err error
 			if !c.server.LMTP {
-				err = c.Session().Data(r)
+				c.bdatQueueID, err = c.sessionData(r)
 			} else {
 				lmtpSession, ok := c.Session().(LMTPSession)
 				if !ok {
@@ -740,6 +1300,7 @@ func (c *Conn) handleBdat(arg string) {
 
 	c.lineLimitReader.LineLimit = 0
 
+	c.setBodyDeadline()
 	chunk := io.LimitReader(c.text.R, int64(size))
 	_, err = io.Copy(c.bdatPipe, chunk)
 	if err != nil {
@@ -750,7 +1311,7 @@ func (c *Conn) handleBdat(arg string) {
 		c.WriteResponse(toSMTPStatus(err))
 
 		if err == errPanic {
-			c.Close()
+			c.close(err)
 		}
 
 		c.reset()
@@ -764,6 +1325,7 @@ func (c *Conn) handleBdat(arg string) {
 		c.lineLimitReader.LineLimit = c.server.MaxLineLength
 
 		c.bdatPipe.Close()
+		c.bdatPipe = nil
 
 		err := <-c.dataResult
 
@@ -774,11 +1336,11 @@ func (c *Conn) handleBdat(arg string) {
 				c.WriteResponse(code, enchCode, "<"+rcpt+"> "+msg)
 			}
 		} else {
-			c.WriteResponse(toSMTPStatus(err))
+			c.WriteResponse(toDataStatus(c.bdatQueueID, err))
 		}
 
 		if err == errPanic {
-			c.Close()
+			c.close(err)
 			return
 		}
 
@@ -803,8 +1365,51 @@ func (c *Conn) handlePanic(err interface{}, status *statusCollector) {
 		status.fillRemaining(errPanic)
 	}
 
-	stack := debug.Stack()
-	c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
+	c.logError("panic serving connection", "error", err, "stack", string(debug.Stack()))
+}
+
+// logError logs an operational error to the server's logger, along with the
+// connection's remote address.
+func (c *Conn) logError(msg string, args ...interface{}) {
+	c.server.logError(msg, c.logArgs(args...)...)
+}
+
+func (c *Conn) logArgs(args ...interface{}) []interface{} {
+	return append([]interface{}{"session_id", c.id, "remote_addr", c.State().RemoteAddr}, args...)
+}
+
+func newSessionID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Errorf("smtp: failed to generate session ID: %v", err))
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// debugWriter prefixes each line written to w.
+type debugWriter struct {
+	w      io.Writer
+	prefix string
+	// Whether the last write ended in the middle of a line
+	midLine bool
+}
+
+func (dw *debugWriter) Write(b []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, line := range bytes.SplitAfter(b, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		if !dw.midLine {
+			buf.WriteString(dw.prefix)
+		}
+		buf.Write(line)
+		dw.midLine = line[len(line)-1] != '\n'
+	}
+	if _, err := dw.w.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(b), nil
 }
 
 func (c *Conn) createStatusCollector() *statusCollector {
@@ -881,7 +1486,10 @@ func (c *Conn) handleDataLMTP() {
 	if !ok {
 		// Fallback to using a single status for all recipients.
 		err := c.Session().Data(r)
-		io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+		r.discard() // Make sure all the data has been consumed
+		if r.exceeded {
+			err = ErrDataTooLarge
+		}
 		for _, rcpt := range c.recipients {
 			status.SetStatus(rcpt, err)
 		}
@@ -896,14 +1504,17 @@ func (c *Conn) handleDataLMTP() {
 						Message:      "Internal server error",
 					})
 
-					stack := debug.Stack()
-					c.server.ErrorLog.Printf("panic serving %v: %v\n%s", c.State().RemoteAddr, err, stack)
+					c.logError("panic serving connection", "error", err, "stack", string(debug.Stack()))
 					done <- false
 				}
 			}()
 
-			status.fillRemaining(lmtpSession.LMTPData(r, status))
-			io.Copy(ioutil.Discard, r) // Make sure all the data has been consumed
+			err := lmtpSession.LMTPData(r, status)
+			r.discard() // Make sure all the data has been consumed
+			if r.exceeded {
+				err = ErrDataTooLarge
+			}
+			status.fillRemaining(err)
 			done <- true
 		}()
 	}
@@ -916,13 +1527,14 @@ func (c *Conn) handleDataLMTP() {
 	// If done gets false, the panic occured in LMTPData and the connection
 	// should be closed.
 	if !<-done {
-		c.Close()
+		c.close(errPanic)
 	}
 }
 
 func toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	if err != nil {
-		if smtperr, ok := err.(*SMTPError); ok {
+		var smtperr *SMTPError
+		if errors.As(err, &smtperr) {
 			return smtperr.Code, smtperr.EnhancedCode, smtperr.Message
 		} else {
 			return 554, EnhancedCode{5, 0, 0}, "Error: transaction failed, blame it on the weather: " + err.Error()
@@ -932,13 +1544,95 @@ func toSMTPStatus(err error) (code int, enchCode EnhancedCode, msg string) {
 	return 250, EnhancedCode{2, 0, 0}, "OK: queued"
 }
 
+// toDataStatus is like toSMTPStatus, but includes the queue ID assigned to an
+// accepted message in the reply.
+func toDataStatus(queueID string, err error) (code int, enchCode EnhancedCode, msg string) {
+	if err == nil && queueID != "" {
+		return 250, EnhancedCode{2, 0, 0}, "OK: queued as " + queueID
+	}
+	return toSMTPStatus(err)
+}
+
 func (c *Conn) Reject() {
 	c.WriteResponse(421, EnhancedCode{4, 4, 5}, "Too busy. Try again later.")
-	c.Close()
+	c.close(errTooBusy)
+}
+
+func (c *Conn) rejectTooManyConns() {
+	c.WriteResponse(421, EnhancedCode{4, 4, 5}, "Too many connections, try again later")
+	c.close(errTooBusy)
+}
+
+// rejectGreeting sends a negative greeting built from err.
+func (c *Conn) rejectGreeting(err error) {
+	code, msg := 554, "Connection rejected"
+	if smtpErr, ok := err.(*SMTPError); ok {
+		code, msg = smtpErr.Code, smtpErr.Message
+	}
+	c.WriteResponse(code, NoEnhancedCode, msg)
+}
+
+// delayGreeting waits for the greeting delay configured for the connection.
+// If Server.RejectEarlyTalkers is set, it returns errEarlyTalker as soon as
+// the client sends data.
+func (c *Conn) delayGreeting() error {
+	delay := c.server.GreetingDelay
+	if c.server.GreetingDelayFunc != nil {
+		delay = c.server.GreetingDelayFunc(c.State().RemoteAddr)
+	}
+	if delay <= 0 {
+		return nil
+	}
+	if !c.server.RejectEarlyTalkers {
+		time.Sleep(delay)
+		return nil
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(delay))
+	_, err := c.text.R.Peek(1)
+	c.conn.SetReadDeadline(time.Time{})
+	if err == nil {
+		return errEarlyTalker
+	} else if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return nil
+	}
+	return err
 }
 
 func (c *Conn) greet() {
-	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v ESMTP Service Ready", c.server.Domain))
+	banner := c.server.Banner
+	if banner == "" {
+		banner = "ESMTP Service Ready"
+	}
+	c.WriteResponse(220, NoEnhancedCode, fmt.Sprintf("%v %v", c.server.Domain, banner))
+}
+
+// helloReply returns the first line of the reply to HELO, EHLO or LHLO, which
+// starts with the server domain (RFC 5321 section 4.1.1.1).
+func (c *Conn) helloReply(clientDomain string) string {
+	if c.server.Domain == "" {
+		return "Hello " + clientDomain
+	}
+	return fmt.Sprintf("%v Hello %v", c.server.Domain, clientDomain)
+}
+
+// interceptReply calls Server.ReplyInterceptor. Its result is ignored if the
+// reply code is invalid, changes a positive reply into a negative one or vice
+// versa, or if the text contains a CR.
+func (c *Conn) interceptReply(code int, enhCode EnhancedCode, text []string) (int, EnhancedCode, []string) {
+	newCode, msg := c.server.ReplyInterceptor(strings.ToUpper(c.cmd), code, strings.Join(text, "\n"))
+	if newCode < 200 || newCode > 599 || strings.Contains(msg, "\r") {
+		return code, enhCode, text
+	}
+	if newCode/100 != code/100 && (newCode < 400 || code < 400) {
+		return code, enhCode, text
+	}
+
+	// The class of the enhanced code must match the reply code
+	if enhCode != EnhancedCodeNotSet && enhCode != NoEnhancedCode {
+		enhCode[0] = newCode / 100
+	}
+	return newCode, enhCode, strings.Split(msg, "\n")
 }
 
 func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
@@ -947,6 +1641,15 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 		c.conn.SetWriteDeadline(time.Now().Add(c.server.WriteTimeout))
 	}
 
+	if c.server.ReplyInterceptor != nil {
+		code, enhCode, text = c.interceptReply(code, enhCode, text)
+	}
+
+	// Enhanced codes can only be used once the client knows about them
+	if !c.enhancedCodes {
+		enhCode = NoEnhancedCode
+	}
+
 	// All responses must include an enhanced code, if it is missing - use
 	// a generic code X.0.0.
 	if enhCode == EnhancedCodeNotSet {
@@ -959,25 +1662,67 @@ func (c *Conn) WriteResponse(code int, enhCode EnhancedCode, text ...string) {
 		}
 	}
 
+	w := c.text.W
 	for i := 0; i < len(text)-1; i++ {
-		c.text.PrintfLine("%d-%v", code, text[i])
+		fmt.Fprintf(w, "%d-%v\r\n", code, text[i])
 	}
 	if enhCode == NoEnhancedCode {
-		c.text.PrintfLine("%d %v", code, text[len(text)-1])
+		fmt.Fprintf(w, "%d %v\r\n", code, text[len(text)-1])
 	} else {
-		c.text.PrintfLine("%d %v.%v.%v %v", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+		fmt.Fprintf(w, "%d %v.%v.%v %v\r\n", code, enhCode[0], enhCode[1], enhCode[2], text[len(text)-1])
+	}
+
+	// Replies to a pipelined group of commands are sent together, once all
+	// the commands already received have been handled (RFC 2920 section 3.2).
+	// 421 replies are always sent immediately since they close the connection.
+	if c.pipelined && code != 421 && c.text.R.Buffered() > 0 {
+		return
+	}
+	w.Flush()
+}
+
+// setBodyDeadline sets the read deadline before a message body is received.
+// Server.IdleTimeout only applies between commands, so that slow but active
+// transfers aren't interrupted.
+func (c *Conn) setBodyDeadline() {
+	var deadline time.Time
+	if c.server.ReadTimeout != 0 {
+		deadline = time.Now().Add(c.server.ReadTimeout)
 	}
+	c.conn.SetReadDeadline(deadline)
 }
 
 // Reads a line of input
 func (c *Conn) ReadLine() (string, error) {
+	var deadline time.Time
 	if c.server.ReadTimeout != 0 {
-		if err := c.conn.SetReadDeadline(time.Now().Add(c.server.ReadTimeout)); err != nil {
+		deadline = time.Now().Add(c.server.ReadTimeout)
+	}
+	if c.server.IdleTimeout != 0 && !c.lastActivity.IsZero() {
+		idleDeadline := c.lastActivity.Add(c.server.IdleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	if !deadline.IsZero() {
+		if err := c.conn.SetReadDeadline(deadline); err != nil {
 			return "", err
 		}
 	}
 
-	return c.text.ReadLine()
+	// Replies to pipelined commands may have been held back, send them before
+	// waiting for more input
+	if b, _ := c.text.R.Peek(c.text.R.Buffered()); bytes.IndexByte(b, '\n') < 0 {
+		c.text.W.Flush()
+	}
+
+	line, err := c.text.R.ReadString('\n')
+	if err != nil {
+		// Partial lines, e.g. interrupted by a timeout, must not be handled
+		// as complete commands
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
 }
 
 func (c *Conn) reset() {
@@ -987,6 +1732,13 @@ func (c *Conn) reset() {
 	if c.bdatPipe != nil {
 		c.bdatPipe.CloseWithError(ErrDataReset)
 		c.bdatPipe = nil
+
+		// Wait for the backend to give up on the message, so that the
+		// session isn't used concurrently. The lock must be released since
+		// the backend goroutine needs it.
+		c.locker.Unlock()
+		<-c.dataResult
+		c.locker.Lock()
 	}
 	c.bdatStatus = nil
 	c.bytesReceived = 0
@@ -0,0 +1,137 @@
+package smtp
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+)
+
+// TLSA certificate usages, as defined in RFC 6698 section 2.1.1.
+const (
+	TLSAUsagePKIXTA = 0
+	TLSAUsagePKIXEE = 1
+	TLSAUsageDANETA = 2
+	TLSAUsageDANEEE = 3
+)
+
+// TLSA selectors, as defined in RFC 6698 section 2.1.2.
+const (
+	TLSASelectorCert = 0
+	TLSASelectorSPKI = 1
+)
+
+// TLSA matching types, as defined in RFC 6698 section 2.1.3.
+const (
+	TLSAMatchingFull   = 0
+	TLSAMatchingSHA256 = 1
+	TLSAMatchingSHA512 = 2
+)
+
+// TLSA is a TLSA DNS record, as defined in RFC 6698.
+//
+// The records must come from a DNSSEC-validated lookup, otherwise they can be
+// forged by an attacker.
+type TLSA struct {
+	Usage        uint8
+	Selector     uint8
+	MatchingType uint8
+	// Certificate association data. For the full matching type, this is the
+	// raw certificate or public key. Otherwise, this is its digest.
+	Data []byte
+}
+
+// matches checks whether the record matches cert.
+func (r *TLSA) matches(cert *x509.Certificate) bool {
+	var data []byte
+	switch r.Selector {
+	case TLSASelectorCert:
+		data = cert.Raw
+	case TLSASelectorSPKI:
+		data = cert.RawSubjectPublicKeyInfo
+	default:
+		return false
+	}
+
+	switch r.MatchingType {
+	case TLSAMatchingFull:
+	case TLSAMatchingSHA256:
+		sum := sha256.Sum256(data)
+		data = sum[:]
+	case TLSAMatchingSHA512:
+		sum := sha512.Sum512(data)
+		data = sum[:]
+	default:
+		return false
+	}
+	return bytes.Equal(data, r.Data)
+}
+
+// DANEConfig returns a TLS configuration which authenticates the server with
+// a set of TLSA records, as specified in RFC 7672. The returned configuration
+// can be passed to Client.StartTLS.
+//
+// Only DANE-TA(2) and DANE-EE(3) records are used, other records are ignored
+// as mandated by RFC 7672. The system root CAs are never trusted: the server
+// certificate is rejected if it doesn't match any of the records. For DANE-TA
+// records, the certificate must be valid for serverName.
+func DANEConfig(serverName string, records []TLSA) *tls.Config {
+	return &tls.Config{
+		ServerName: serverName,
+		// Verification is performed by VerifyConnection instead
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			return verifyDANE(cs.PeerCertificates, serverName, records)
+		},
+	}
+}
+
+func verifyDANE(certs []*x509.Certificate, serverName string, records []TLSA) error {
+	if len(certs) == 0 {
+		return errors.New("smtp: DANE: server didn't present a certificate")
+	}
+	leaf := certs[0]
+
+	usable := false
+	for _, r := range records {
+		switch r.Usage {
+		case TLSAUsageDANEEE:
+			usable = true
+			// The name and validity period aren't checked for DANE-EE
+			// (RFC 7672 section 3.1.1)
+			if r.matches(leaf) {
+				return nil
+			}
+		case TLSAUsageDANETA:
+			usable = true
+			for _, ta := range certs[1:] {
+				if r.matches(ta) && verifyDANETA(leaf, ta, certs[1:], serverName) == nil {
+					return nil
+				}
+			}
+		}
+	}
+	if !usable {
+		return errors.New("smtp: DANE: no usable TLSA record")
+	}
+	return errors.New("smtp: DANE: server certificate doesn't match any TLSA record")
+}
+
+// verifyDANETA checks that leaf is valid for serverName and chains to the
+// trust anchor ta.
+func verifyDANETA(leaf, ta *x509.Certificate, intermediates []*x509.Certificate, serverName string) error {
+	roots := x509.NewCertPool()
+	roots.AddCert(ta)
+	pool := x509.NewCertPool()
+	for _, cert := range intermediates {
+		pool.AddCert(cert)
+	}
+	_, err := leaf.Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         roots,
+		Intermediates: pool,
+	})
+	return err
+}
@@ -2,7 +2,11 @@ package smtp
 
 import (
 	"bufio"
+	"errors"
 	"io"
+	"io/ioutil"
+	"net"
+	"time"
 )
 
 type EnhancedCode [3]int
@@ -36,6 +40,23 @@ func (err *SMTPError) Temporary() bool {
 	return err.Code/100 == 4
 }
 
+// IsTemporary reports whether err is, or wraps, a transient negative reply
+// (4xx) from the server. The failed command may succeed if retried later.
+func IsTemporary(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code/100 == 4
+}
+
+// IsPermanent reports whether err is, or wraps, a permanent negative reply
+// (5xx) from the server. The failed command should not be retried as is.
+//
+// Errors which don't come from a server reply, such as network errors, are
+// neither temporary nor permanent.
+func IsPermanent(err error) bool {
+	var smtpErr *SMTPError
+	return errors.As(err, &smtpErr) && smtpErr.Code/100 == 5
+}
+
 var ErrDataTooLarge = &SMTPError{
 	Code:         552,
 	EnhancedCode: EnhancedCode{5, 3, 4},
@@ -46,33 +67,69 @@ type dataReader struct {
 	r     *bufio.Reader
 	state int
 
-	limited bool
-	n       int64 // Maximum bytes remaining
+	// The read deadline is extended by readTimeout each time a line is
+	// received, so that slow but steady transfers aren't interrupted
+	conn        net.Conn
+	readTimeout time.Duration
+
+	limited  bool
+	n        int64 // Maximum bytes remaining
+	exceeded bool  // whether the message is larger than the limit
+
+	tooLongLine bool // whether a line is longer than Server.MaxLineLength
 }
 
 func newDataReader(c *Conn) *dataReader {
+	c.setBodyDeadline()
+
 	dr := &dataReader{
-		r: c.text.R,
+		r:           c.text.R,
+		conn:        c.conn,
+		readTimeout: c.server.ReadTimeout,
 	}
 
-	if c.server.MaxMessageBytes > 0 {
+	if maxBytes := c.maxMessageBytes(); maxBytes > 0 {
 		dr.limited = true
-		dr.n = int64(c.server.MaxMessageBytes)
+		dr.n = int64(maxBytes)
 	}
 
 	return dr
 }
 
 func (r *dataReader) Read(b []byte) (n int, err error) {
-	if r.limited {
-		if r.n <= 0 {
-			return 0, ErrDataTooLarge
-		}
-		if int64(len(b)) > r.n {
-			b = b[0:r.n]
+	if !r.limited {
+		return r.read(b)
+	}
+
+	if r.exceeded {
+		return 0, ErrDataTooLarge
+	}
+	if r.n <= 0 {
+		// The message is exactly as large as the limit if only the end
+		// marker is left
+		var buf [1]byte
+		if n, err := r.read(buf[:]); n == 0 {
+			return 0, err
 		}
+		r.exceeded = true
+		return 0, ErrDataTooLarge
+	}
+	if int64(len(b)) > r.n {
+		b = b[0:r.n]
 	}
+	n, err = r.read(b)
+	r.n -= int64(n)
+	return n, err
+}
+
+// discard consumes the rest of the message, up to the end marker, without
+// enforcing the size limit.
+func (r *dataReader) discard() {
+	r.limited = false
+	io.Copy(ioutil.Discard, r)
+}
 
+func (r *dataReader) read(b []byte) (n int, err error) {
 	// Code below is taken from net/textproto with only one modification to
 	// not rewrite CRLF -> LF.
 
@@ -93,6 +150,9 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 			if err == io.EOF {
 				err = io.ErrUnexpectedEOF
 			}
+			if err == ErrTooLongLine {
+				r.tooLongLine = true
+			}
 			break
 		}
 		switch r.state {
@@ -135,13 +195,13 @@ func (r *dataReader) Read(b []byte) (n int, err error) {
 		}
 		b[n] = c
 		n++
+
+		if r.state == stateBeginLine && r.readTimeout != 0 {
+			r.conn.SetReadDeadline(time.Now().Add(r.readTimeout))
+		}
 	}
 	if err == nil && r.state == stateEOF {
 		err = io.EOF
 	}
-
-	if r.limited {
-		r.n -= int64(n)
-	}
 	return
 }
@@ -0,0 +1,35 @@
+package smtp
+
+import (
+	"bufio"
+	"io"
+	"net/textproto"
+)
+
+// DotEncoder returns a writer that applies the transparency procedure of
+// RFC 5321 section 4.5.2 to the message written to it, as done by
+// Client.Data: a dot is prepended to lines starting with a dot, and bare LF
+// line endings are converted to CRLF.
+//
+// Writes are buffered. Close terminates the message with the "\r\n.\r\n" end
+// marker (the leading CRLF is omitted if the message already ends with a line
+// break) and flushes the data to w. Close does not close w.
+func DotEncoder(w io.Writer) io.WriteCloser {
+	return textproto.NewWriter(bufio.NewWriter(w)).DotWriter()
+}
+
+// DotReader returns a reader that decodes a message encoded with the
+// transparency procedure of RFC 5321 section 4.5.2, as done by the server
+// for the DATA command: the leading dot of each line is removed. Line endings
+// are left untouched.
+//
+// The reader returns io.EOF once the ".\r\n" end marker has been read, and
+// io.ErrUnexpectedEOF if r ends before it. Data following the end marker may
+// have been consumed from r, unless r is a *bufio.Reader.
+func DotReader(r io.Reader) io.Reader {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &dataReader{r: br}
+}
@@ -28,7 +28,7 @@ func ExampleDial() {
 	if err := c.Mail("sender@example.org", nil); err != nil {
 		log.Fatal(err)
 	}
-	if err := c.Rcpt("recipient@example.net"); err != nil {
+	if err := c.Rcpt("recipient@example.net", nil); err != nil {
 		log.Fatal(err)
 	}
 
@@ -61,7 +61,7 @@ var (
 	recipients = []string{"foo@example.com"}
 )
 
-func ExampleSendMail_PlainAuth() {
+func ExampleSendMail_plainAuth() {
 	// hostname is used by PlainAuth to validate the TLS certificate.
 	hostname := "mail.example.com"
 	auth := sasl.NewPlainClient("", "user@example.com", "password")
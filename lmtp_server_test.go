@@ -28,7 +28,7 @@ func sendDeliveryCmdsLMTP(t *testing.T, scanner *bufio.Scanner, c io.Writer) {
 func sendLHLO(t *testing.T, scanner *bufio.Scanner, c io.Writer) {
 	io.WriteString(c, "LHLO localhost\r\n")
 	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
+	if scanner.Text() != "250-localhost Hello localhost" {
 		t.Fatal("Invalid LHLO response:", scanner.Text())
 	}
 	for scanner.Scan() {
@@ -195,3 +195,56 @@ func TestServer_LMTP_DuplicatedRcpt(t *testing.T) {
 		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
 	}
 }
+
+func TestServer_LMTP_RejectedRcpt(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.LMTP = true
+		s.MaxRecipients = 2
+		be := s.Backend.(*backend)
+		be.implementLMTPData = true
+		be.lmtpStatus = []struct {
+			addr string
+			err  error
+		}{
+			{"root@gchq.gov.uk", nil},
+			{"root@bnd.bund.de", &smtp.SMTPError{Code: 552, EnhancedCode: smtp.EnhancedCode{5, 2, 2}, Message: "Mailbox full"}},
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	sendLHLO(t, scanner, c)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@dgse.gouv.fr>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "452 ") {
+		t.Fatal("Invalid RCPT response, expected an error but got:", scanner.Text())
+	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+
+	// One reply per accepted recipient, none for the rejected one
+	for _, want := range []string{"250 ", "552 5.2.2 <root@bnd.bund.de> Mailbox full"} {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), want) {
+			t.Fatalf("Invalid DATA response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
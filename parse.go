@@ -12,6 +12,10 @@ func parseCmd(line string) (cmd string, arg string, err error) {
 	switch {
 	case strings.HasPrefix(strings.ToUpper(line), "STARTTLS"):
 		return "STARTTLS", "", nil
+	case strings.ToUpper(line) == "XCLIENT":
+		return "XCLIENT", "", nil
+	case strings.HasPrefix(strings.ToUpper(line), "XCLIENT "):
+		return "XCLIENT", strings.Trim(line[8:], " \n\r"), nil
 	case l == 0:
 		return "", "", nil
 	case l < 4:
@@ -0,0 +1,145 @@
+package smtp
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+var errInvalidProxyHeader = errors.New("smtp: invalid PROXY protocol header")
+
+// Maximum length of a PROXY protocol v1 header, including the CRLF.
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, as defined in
+// https://www.haproxy.org/download/2.0/doc/proxy-protocol.txt.
+//
+// It returns nil addresses if the header doesn't carry the original
+// connection addresses, e.g. for health checks. The header is read without
+// buffering, so that the data following it is left untouched.
+func readProxyHeader(r io.Reader) (src, dst net.Addr, err error) {
+	var b [1]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return nil, nil, err
+	}
+
+	switch b[0] {
+	case 'P':
+		return readProxyHeaderV1(r)
+	case proxyV2Signature[0]:
+		return readProxyHeaderV2(r)
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+}
+
+func readProxyHeaderV1(r io.Reader) (src, dst net.Addr, err error) {
+	line := []byte{'P'}
+	var b [1]byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, nil, errInvalidProxyHeader
+		}
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		// The rest of the line must be ignored
+		return nil, nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+	if len(fields) != 6 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	srcIP, dstIP := net.ParseIP(fields[2]), net.ParseIP(fields[3])
+	if srcIP == nil || dstIP == nil || (srcIP.To4() != nil) != (fields[1] == "TCP4") {
+		return nil, nil, errInvalidProxyHeader
+	}
+	srcPort, err := parseProxyPort(fields[4])
+	if err != nil {
+		return nil, nil, err
+	}
+	dstPort, err := parseProxyPort(fields[5])
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return &net.TCPAddr{IP: srcIP, Port: srcPort}, &net.TCPAddr{IP: dstIP, Port: dstPort}, nil
+}
+
+func parseProxyPort(s string) (int, error) {
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || (len(s) > 1 && s[0] == '0') {
+		return 0, errInvalidProxyHeader
+	}
+	return int(port), nil
+}
+
+func readProxyHeaderV2(r io.Reader) (src, dst net.Addr, err error) {
+	// The first byte of the signature has already been read
+	var hdr [16]byte
+	hdr[0] = proxyV2Signature[0]
+	if _, err := io.ReadFull(r, hdr[1:]); err != nil {
+		return nil, nil, err
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	verCmd, fam := hdr[12], hdr[13]
+	if verCmd>>4 != 2 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	data := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, nil, err
+	}
+
+	switch verCmd & 0xF {
+	case 0x0: // LOCAL
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	var ipLen int
+	switch fam {
+	case 0x11: // TCP over IPv4
+		ipLen = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLen = net.IPv6len
+	default:
+		// Other families aren't relevant for SMTP, the addresses are
+		// ignored
+		return nil, nil, nil
+	}
+	if len(data) < 2*ipLen+4 {
+		return nil, nil, errInvalidProxyHeader
+	}
+
+	srcIP := net.IP(data[:ipLen])
+	dstIP := net.IP(data[ipLen : 2*ipLen])
+	srcPort := binary.BigEndian.Uint16(data[2*ipLen:])
+	dstPort := binary.BigEndian.Uint16(data[2*ipLen+2:])
+	return &net.TCPAddr{IP: srcIP, Port: int(srcPort)}, &net.TCPAddr{IP: dstIP, Port: int(dstPort)}, nil
+}
@@ -0,0 +1,170 @@
+package smtp
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+)
+
+// ReceivedHeader builds a Received header field for a message received on
+// the connection, as defined in RFC 5321 section 4.4. The returned string
+// includes the field name and ends with CRLF, so that it can be prepended to
+// the message as is.
+//
+// The protocol type follows RFC 3848, e.g. ESMTPSA for a message received
+// with EHLO over TLS from an authenticated client, and the negotiated TLS
+// version and cipher suite are included in a comment. No DNS lookup is
+// performed: the client's host name is only included if it was asserted with
+// XCLIENT. If there is exactly one recipient, a "for" clause is added.
+func (c *Conn) ReceivedHeader() string {
+	state := c.State()
+
+	var sb strings.Builder
+	sb.WriteString("Received: from ")
+	sb.WriteString(state.Hostname)
+
+	var info []string
+	if state.XClient != nil && state.XClient.Name != "" {
+		info = append(info, state.XClient.Name)
+	}
+	if ip := addrIP(state.RemoteAddr); ip != nil {
+		info = append(info, "["+ip.String()+"]")
+	}
+	if len(info) > 0 {
+		sb.WriteString(" (" + strings.Join(info, " ") + ")")
+	}
+
+	sb.WriteString("\r\n\tby ")
+	sb.WriteString(c.server.Domain)
+
+	sb.WriteString(" with ")
+	sb.WriteString(c.receivedProtocol())
+	if tlsState, ok := c.TLSConnectionState(); ok {
+		fmt.Fprintf(&sb, " (%v cipher=%v)", tlsVersionName(tlsState.Version), tls.CipherSuiteName(tlsState.CipherSuite))
+	}
+
+	sb.WriteString("\r\n\tid ")
+	sb.WriteString(c.id)
+	if len(c.recipients) == 1 {
+		sb.WriteString("\r\n\tfor <" + c.recipients[0] + ">")
+	}
+
+	sb.WriteString(";\r\n\t")
+	sb.WriteString(time.Now().Format(time.RFC1123Z))
+	sb.WriteString("\r\n")
+	return sb.String()
+}
+
+// receivedProtocol returns the protocol type of the connection, as defined in
+// RFC 3848.
+func (c *Conn) receivedProtocol() string {
+	proto := "SMTP"
+	if c.server.LMTP {
+		proto = "LMTP"
+	} else if c.ehlo {
+		proto = "ESMTP"
+	}
+	if _, ok := c.TLSConnectionState(); ok && c.ehlo {
+		proto += "S"
+	}
+	if c.didAuth && c.ehlo {
+		proto += "A"
+	}
+	return proto
+}
+
+func addrIP(addr net.Addr) net.IP {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP
+	case *net.UDPAddr:
+		return addr.IP
+	default:
+		return nil
+	}
+}
+
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS1.0"
+	case tls.VersionTLS11:
+		return "TLS1.1"
+	case tls.VersionTLS12:
+		return "TLS1.2"
+	case tls.VersionTLS13:
+		return "TLS1.3"
+	default:
+		return fmt.Sprintf("0x%04X", version)
+	}
+}
+
+// ErrTooManyHops can be returned by backends to reject a message which went
+// through too many relays, most likely because of a mail loop (RFC 5321
+// section 6.3).
+var ErrTooManyHops = &SMTPError{
+	Code:         554,
+	EnhancedCode: EnhancedCode{5, 4, 6},
+	Message:      "Too many hops, routing loop detected",
+}
+
+var receivedFieldName = []byte("Received:")
+
+// ReceivedHops counts the Received header fields of a message, i.e. the
+// number of relays it went through. Relays can use it to detect mail loops,
+// and reject a message with ErrTooManyHops if the count exceeds a limit (RFC
+// 5321 suggests at least 100).
+//
+// Only the header is read from r: reading stops at the empty line separating
+// it from the body. If r is a *bufio.Reader, no data past that line is
+// consumed. Since the header is consumed, r is typically an io.TeeReader or a
+// copy of the beginning of the message.
+func ReceivedHops(r io.Reader) (int, error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	hops := 0
+	lineStart := true
+	for {
+		line, err := br.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// Long line: only its beginning matters
+			if lineStart && hasFieldName(line, receivedFieldName) {
+				hops++
+			}
+			lineStart = false
+			continue
+		} else if err == io.EOF {
+			// Message without a body
+			if lineStart && hasFieldName(line, receivedFieldName) {
+				hops++
+			}
+			return hops, nil
+		} else if err != nil {
+			return hops, err
+		}
+
+		if lineStart {
+			if len(line) == 1 || (len(line) == 2 && line[0] == '\r') {
+				return hops, nil
+			}
+			if hasFieldName(line, receivedFieldName) {
+				hops++
+			}
+		}
+		lineStart = true
+	}
+}
+
+// hasFieldName reports whether line starts with the field name name,
+// including the colon. Field names are case-insensitive.
+func hasFieldName(line, name []byte) bool {
+	return len(line) >= len(name) && bytes.EqualFold(line[:len(name)], name)
+}
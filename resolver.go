@@ -0,0 +1,131 @@
+package smtp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resolver looks up DNS records. It's implemented by *net.Resolver.
+type Resolver interface {
+	LookupMX(ctx context.Context, name string) ([]*net.MX, error)
+	LookupHost(ctx context.Context, host string) (addrs []string, err error)
+}
+
+// Maximum number of entries kept by the resolver returned by
+// NewCachingResolver.
+const maxResolverCacheEntries = 10000
+
+type resolverCacheEntry struct {
+	mx      []*net.MX
+	addrs   []string
+	err     error
+	expires time.Time
+}
+
+type cachingResolver struct {
+	r   Resolver
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[string]*resolverCacheEntry
+}
+
+// NewCachingResolver returns a Resolver which caches the results of r for ttl.
+// Successful lookups and lookups of names which don't exist are cached, but
+// temporary failures aren't.
+func NewCachingResolver(r Resolver, ttl time.Duration) Resolver {
+	return &cachingResolver{
+		r:       r,
+		ttl:     ttl,
+		entries: make(map[string]*resolverCacheEntry),
+	}
+}
+
+func (cr *cachingResolver) get(key string) *resolverCacheEntry {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	entry := cr.entries[key]
+	if entry != nil && time.Now().After(entry.expires) {
+		delete(cr.entries, key)
+		return nil
+	}
+	return entry
+}
+
+func (cr *cachingResolver) put(key string, entry *resolverCacheEntry) {
+	var dnsErr *net.DNSError
+	if entry.err != nil && !(errors.As(entry.err, &dnsErr) && dnsErr.IsNotFound) {
+		return
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	now := time.Now()
+	if len(cr.entries) >= maxResolverCacheEntries {
+		for k, e := range cr.entries {
+			if now.After(e.expires) {
+				delete(cr.entries, k)
+			}
+		}
+	}
+	if len(cr.entries) >= maxResolverCacheEntries {
+		cr.entries = make(map[string]*resolverCacheEntry)
+	}
+
+	entry.expires = now.Add(cr.ttl)
+	cr.entries[key] = entry
+}
+
+func (cr *cachingResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	key := "mx:" + strings.ToLower(name)
+	if entry := cr.get(key); entry != nil {
+		return entry.mx, entry.err
+	}
+
+	mx, err := cr.r.LookupMX(ctx, name)
+	cr.put(key, &resolverCacheEntry{mx: mx, err: err})
+	return mx, err
+}
+
+func (cr *cachingResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	key := "host:" + strings.ToLower(host)
+	if entry := cr.get(key); entry != nil {
+		return entry.addrs, entry.err
+	}
+
+	addrs, err := cr.r.LookupHost(ctx, host)
+	cr.put(key, &resolverCacheEntry{addrs: addrs, err: err})
+	return addrs, err
+}
+
+// Maximum duration of the lookups made for Server.RequireValidSenderDomain.
+const senderDomainLookupTimeout = 10 * time.Second
+
+// senderDomainResolves checks whether the domain of the sender address from
+// has MX or address records. The null reverse-path, addresses without a
+// domain and address literals are always accepted.
+func senderDomainResolves(r Resolver, from string) bool {
+	i := strings.LastIndexByte(from, '@')
+	if i < 0 {
+		return true
+	}
+	domain := from[i+1:]
+	if domain == "" || strings.HasPrefix(domain, "[") {
+		return true
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), senderDomainLookupTimeout)
+	defer cancel()
+
+	if mx, err := r.LookupMX(ctx, domain); err == nil && len(mx) > 0 {
+		return true
+	}
+	addrs, err := r.LookupHost(ctx, domain)
+	return err == nil && len(addrs) > 0
+}
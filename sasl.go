@@ -0,0 +1,238 @@
+package smtp
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/emersion/go-sasl"
+)
+
+// cramMD5Client implements the CRAM-MD5 mechanism, as described in RFC 2195.
+type cramMD5Client struct {
+	username, secret string
+}
+
+func newCramMD5Client(username, secret string) sasl.Client {
+	return &cramMD5Client{username, secret}
+}
+
+func (a *cramMD5Client) Start() (mech string, ir []byte, err error) {
+	return "CRAM-MD5", nil, nil
+}
+
+func (a *cramMD5Client) Next(challenge []byte) ([]byte, error) {
+	d := hmac.New(md5.New, []byte(a.secret))
+	d.Write(challenge)
+	return []byte(a.username + " " + hex.EncodeToString(d.Sum(nil))), nil
+}
+
+// xoauth2Client implements the XOAUTH2 mechanism used by Gmail and Office 365.
+type xoauth2Client struct {
+	username, token string
+
+	// details is the JSON error sent by the server when the token is
+	// rejected.
+	details []byte
+}
+
+func (a *xoauth2Client) Start() (mech string, ir []byte, err error) {
+	ir = []byte("user=" + a.username + "\x01auth=Bearer " + a.token + "\x01\x01")
+	return "XOAUTH2", ir, nil
+}
+
+func (a *xoauth2Client) Next(challenge []byte) ([]byte, error) {
+	// The server sends error details as a challenge and expects an empty
+	// response, then fails the exchange.
+	a.details = challenge
+	return []byte{}, nil
+}
+
+// XOAuth2Error is returned by AuthXOAuth2 when the server rejects the token.
+type XOAuth2Error struct {
+	*SMTPError
+
+	// Error details sent by the server, if any.
+	Status  string `json:"status"`
+	Schemes string `json:"schemes"`
+	Scope   string `json:"scope"`
+}
+
+func (err *XOAuth2Error) Error() string {
+	if err.Status == "" {
+		return err.SMTPError.Error()
+	}
+	return fmt.Sprintf("%v (status %v)", err.SMTPError.Error(), err.Status)
+}
+
+func (err *XOAuth2Error) Unwrap() error {
+	return err.SMTPError
+}
+
+func newXOAuth2Error(smtpErr *SMTPError, details []byte) *XOAuth2Error {
+	// Details are optional, ignore them if malformed. Don't unmarshal into
+	// XOAuth2Error directly: that would let the server overwrite the
+	// promoted SMTPError fields.
+	var v struct {
+		Status  string `json:"status"`
+		Schemes string `json:"schemes"`
+		Scope   string `json:"scope"`
+	}
+	json.Unmarshal(details, &v)
+	return &XOAuth2Error{
+		SMTPError: smtpErr,
+		Status:    v.Status,
+		Schemes:   v.Schemes,
+		Scope:     v.Scope,
+	}
+}
+
+// mutualAuthClient is implemented by SASL clients which authenticate the
+// server as well. serverVerified returns an error if the server hasn't proven
+// its identity by the time it reports success.
+type mutualAuthClient interface {
+	serverVerified() error
+}
+
+// scramClient implements the SCRAM-SHA-256 mechanism, as described in RFC
+// 5802 and RFC 7677. Channel binding is not supported.
+//
+// The password is used as-is, without SASLprep normalization.
+type scramClient struct {
+	username, password string
+	nonce              string
+
+	step            int
+	clientFirstBare string
+	serverSignature []byte
+	verified        bool
+}
+
+const scramGS2Header = "n,,"
+
+// Maximum iteration count accepted from the server. Higher values would let
+// a malicious server make the client spend a long time hashing the password.
+const scramMaxIterations = 100000
+
+func newScramSHA256Client(username, password string) sasl.Client {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return &scramClient{
+		username: username,
+		password: password,
+		nonce:    base64.RawStdEncoding.EncodeToString(b),
+	}
+}
+
+func (a *scramClient) Start() (mech string, ir []byte, err error) {
+	// Escape the username as a saslname, as defined in RFC 5802 section 5.1
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(a.username)
+	a.clientFirstBare = "n=" + name + ",r=" + a.nonce
+	return "SCRAM-SHA-256", []byte(scramGS2Header + a.clientFirstBare), nil
+}
+
+func (a *scramClient) Next(challenge []byte) ([]byte, error) {
+	a.step++
+	switch a.step {
+	case 1:
+		return a.clientFinal(string(challenge))
+	case 2:
+		attrs := parseScramAttrs(string(challenge))
+		if e, ok := attrs["e"]; ok {
+			return nil, errors.New("smtp: SCRAM authentication failed: " + e)
+		}
+		v, err := base64.StdEncoding.DecodeString(attrs["v"])
+		if err != nil || !hmac.Equal(v, a.serverSignature) {
+			return nil, errors.New("smtp: invalid SCRAM server signature")
+		}
+		a.verified = true
+		return []byte{}, nil
+	default:
+		return nil, sasl.ErrUnexpectedServerChallenge
+	}
+}
+
+func (a *scramClient) serverVerified() error {
+	if !a.verified {
+		return errors.New("smtp: SCRAM server signature missing")
+	}
+	return nil
+}
+
+func (a *scramClient) clientFinal(serverFirst string) ([]byte, error) {
+	attrs := parseScramAttrs(serverFirst)
+	nonce := attrs["r"]
+	if !strings.HasPrefix(nonce, a.nonce) || len(nonce) == len(a.nonce) {
+		return nil, errors.New("smtp: invalid SCRAM server nonce")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		return nil, errors.New("smtp: invalid SCRAM salt")
+	}
+	iter, err := strconv.Atoi(attrs["i"])
+	if err != nil || iter <= 0 || iter > scramMaxIterations {
+		return nil, errors.New("smtp: invalid SCRAM iteration count")
+	}
+
+	saltedPassword := pbkdf2SHA256([]byte(a.password), salt, iter)
+	clientKey := hmacSHA256(saltedPassword, []byte("Client Key"))
+	storedKey := sha256.Sum256(clientKey)
+	serverKey := hmacSHA256(saltedPassword, []byte("Server Key"))
+
+	clientFinal := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	authMessage := []byte(a.clientFirstBare + "," + serverFirst + "," + clientFinal)
+
+	proof := hmacSHA256(storedKey[:], authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	a.serverSignature = hmacSHA256(serverKey, authMessage)
+
+	clientFinal += ",p=" + base64.StdEncoding.EncodeToString(proof)
+	return []byte(clientFinal), nil
+}
+
+func parseScramAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(s, ",") {
+		if kv := strings.SplitN(attr, "=", 2); len(kv) == 2 {
+			attrs[kv[0]] = kv[1]
+		}
+	}
+	return attrs
+}
+
+func hmacSHA256(key, msg []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(msg)
+	return h.Sum(nil)
+}
+
+// pbkdf2SHA256 derives a key of sha256.Size bytes with PBKDF2, as defined in
+// RFC 8018 section 5.2. Only the first block is needed.
+func pbkdf2SHA256(password, salt []byte, iter int) []byte {
+	prf := hmac.New(sha256.New, password)
+	prf.Write(salt)
+	prf.Write([]byte{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iter; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
@@ -1,19 +1,30 @@
 package smtp
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"runtime/debug"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/emersion/go-sasl"
 )
 
-var errTCPAndLMTP = errors.New("smtp: cannot start LMTP server listening on a TCP socket")
+var (
+	errTCPAndLMTP  = errors.New("smtp: cannot start LMTP server listening on a TCP socket")
+	errTLSAndProxy = errors.New("smtp: PROXY protocol cannot be used with a TLS listener")
+)
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// have been closed.
+const shutdownPollInterval = 50 * time.Millisecond
 
 // A function that creates SASL servers.
 type SaslServerFactory func(conn *Conn) sasl.Server
@@ -24,39 +35,180 @@ type Logger interface {
 	Println(v ...interface{})
 }
 
+// StructuredLogger is a leveled logger taking alternating key-value pairs
+// after the message. It is implemented by *slog.Logger.
+type StructuredLogger interface {
+	Error(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+}
+
 // A SMTP server.
 type Server struct {
 	// TCP or Unix address to listen on.
 	Addr string
 	// The server TLS configuration.
 	TLSConfig *tls.Config
+	// TLS configurations for specific host names, keyed by the lower-case
+	// host name requested by the client via SNI. This allows serving
+	// multiple mail domains with different certificates on one listener.
+	// TLSConfig must be set as well: it's used for clients which don't send
+	// SNI or request an unknown host name.
+	TLSConfigForHost map[string]*tls.Config
 	// Enable LMTP mode, as defined in RFC 2033. LMTP mode cannot be used with a
 	// TCP listener.
+	//
+	// Once a message has been received, one reply is sent per accepted
+	// recipient. Backends provide them by implementing LMTPSession, otherwise
+	// the result of Session.Data is used for all recipients.
 	LMTP bool
 
-	Domain            string
-	MaxRecipients     int
-	MaxMessageBytes   int
-	MaxLineLength     int
+	// Domain of the server, sent in the greeting and in the reply to
+	// HELO, EHLO and LHLO. It should match the reverse DNS of the server's
+	// IP address.
+	Domain string
+	// Free-text part of the greeting sent after Domain. Defaults to
+	// "ESMTP Service Ready".
+	Banner string
+	// Text of the reply to HELP, with lines separated by LF. It's sent as a
+	// multiline 214 reply. If empty, HELP is rejected with a 502 reply.
+	HelpText string
+
+	// Maximum number of recipients per message. Additional RCPT commands
+	// are rejected with a 452 reply. Zero means no limit.
+	MaxRecipients int
+	// Maximum size of messages, in bytes, advertised with the SIZE
+	// capability. Zero means no limit. It can be overridden per session, see
+	// MessageSizeSession.
+	MaxMessageBytes int
+	// Maximum length of a command line or a line of a message, as a DoS
+	// protection. Longer lines are rejected with a 500 reply and the
+	// connection is closed. NewServer sets it to 2000, twice the RFC 5321
+	// limit. Zero means no limit.
+	MaxLineLength int
+	// Allow authentication over cleartext connections. Otherwise, AUTH isn't
+	// advertised and is rejected with a 538 reply until TLS is in use.
 	AllowInsecureAuth bool
+	// Reject MAIL with a 530 reply until TLS is in use. Not to be confused
+	// with EnableREQUIRETLS.
+	RequireTLSForMail bool
 	Strict            bool
-	Debug             io.Writer
-	ErrorLog          Logger
-	ReadTimeout       time.Duration
-	WriteTimeout      time.Duration
+	// Raw trace of the SMTP traffic.
+	Debug    io.Writer
+	ErrorLog Logger
+	// Structured logger for accept errors, panics in the backend and
+	// protocol violations, with fields such as the remote address, the
+	// command and the reply code. If nil, errors are logged to ErrorLog and
+	// protocol violations aren't logged.
+	Logger StructuredLogger
+
+	// ReplyInterceptor is called for each reply sent by the server, with the
+	// command being handled (empty for the greeting and other unsolicited
+	// replies), the reply code and the reply text, whose lines are separated
+	// by LF. It returns the code and text to send instead, e.g. to soften 550
+	// replies into 450 during a grace period.
+	//
+	// The result is ignored if the code isn't between 200 and 599, if a
+	// positive reply is turned into a negative one or vice versa, or if the
+	// text contains a CR. The class of the enhanced status code is adjusted
+	// to the new code.
+	ReplyInterceptor func(cmd string, code int, msg string) (int, string)
+
+	// Maximum duration to wait for a command line or a line of a message,
+	// and to send a reply. Fresh deadlines are set for each of them. Zero
+	// means no timeout.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// Maximum duration a session may stay idle between commands, regardless
+	// of ReadTimeout. NOOP doesn't count as activity, so that clients can't
+	// keep a session open forever. Zero means no timeout.
+	IdleTimeout time.Duration
+
+	// Maximum number of simultaneous connections. Additional connections are
+	// rejected with a 421 reply. Zero means no limit.
+	MaxConnections int
+
+	// ConnectionChecker is called for each new connection, before the
+	// greeting is sent. It can be used to implement per-IP rate limits or
+	// denylists. If it returns an error, the connection is rejected: the
+	// greeting carries the error's code and message if it's an SMTPError,
+	// and a 554 reply otherwise.
+	ConnectionChecker func(remoteAddr net.Addr) error
+
+	// Delay before the greeting is sent. Legitimate clients wait for the
+	// greeting, while spambots often start talking right away. If
+	// GreetingDelayFunc is set, it's called for each connection instead, so
+	// that only suspicious clients are delayed.
+	GreetingDelay     time.Duration
+	GreetingDelayFunc func(remoteAddr net.Addr) time.Duration
+	// Close connections on which the client sends data during the greeting
+	// delay, with a 554 reply.
+	RejectEarlyTalkers bool
+
+	// Expect a PROXY protocol v1 or v2 header at the start of each
+	// connection, as sent by HAProxy and other load balancers. The addresses
+	// it carries are reported in ConnectionState. Connections with a missing
+	// or malformed header are closed.
+	//
+	// The header is read before the TLS handshake, so the listener passed to
+	// Serve must not be a TLS listener.
+	EnableProxyProtocol bool
+
+	// Reject MAIL with a 450 reply if the domain of the sender address has
+	// neither MX nor address records, a common anti-spam check. The null
+	// reverse-path and address literals aren't checked.
+	RequireValidSenderDomain bool
+	// Resolver used for RequireValidSenderDomain. If nil, net.DefaultResolver
+	// is used. NewCachingResolver can be used to avoid repeated lookups.
+	Resolver Resolver
+
+	// Networks of the trusted relays allowed to use the XCLIENT command to
+	// assert the original client's attributes. The attributes are reported in
+	// ConnectionState.
+	TrustedXClientNets []net.IPNet
 
 	// Advertise SMTPUTF8 (RFC 6531) capability.
 	// Should be used only if backend supports it.
+	//
+	// Non-ASCII addresses are only accepted in transactions started with the
+	// SMTPUTF8 parameter, which requires this capability.
 	EnableSMTPUTF8 bool
 
 	// Advertise REQUIRETLS (RFC 8689) capability.
 	// Should be used only if backend supports it.
+	//
+	// The capability is only advertised over TLS, and the REQUIRETLS
+	// parameter is rejected over cleartext connections. Backends relaying
+	// messages with MailOptions.RequireTLS set must refuse to deliver them
+	// without TLS.
 	EnableREQUIRETLS bool
 
+	// Advertise ENHANCEDSTATUSCODES (RFC 2034) capability. Replies sent after
+	// EHLO or LHLO then carry the RFC 3463 enhanced status code, e.g.
+	// "550 5.7.1". Enabled by default by NewServer.
+	EnableEnhancedStatusCodes bool
+
 	// Advertise BINARYMIME (RFC 3030) capability.
 	// Should be used only if backend supports it.
+	//
+	// BINARYMIME messages can only be sent with BDAT, so this requires the
+	// CHUNKING capability, which is advertised by servers created with
+	// NewServer.
 	EnableBINARYMIME bool
 
+	// Advertise DSN (RFC 3461) capability. The DSN parameters are passed to
+	// the backend through MailOptions and RcptOptions, see
+	// RcptOptionsSession.
+	// Should be used only if backend supports it.
+	EnableDSN bool
+
+	// Commands which are rejected with a 502 reply, e.g. VRFY and EXPN, which
+	// can leak information about mailboxes. The extensions they belong to
+	// aren't advertised. Only optional commands can be disabled: VRFY, EXPN,
+	// HELP, NOOP, STARTTLS, AUTH, BDAT and XCLIENT. Commands which aren't
+	// implemented, such as ETRN or TURN, are always rejected, listing them
+	// is allowed but has no effect.
+	DisabledCommands []string
+
 	// If set, the AUTH command will not be advertised and authentication
 	// attempts will be rejected. This setting overrides AllowInsecureAuth.
 	AuthDisabled bool
@@ -64,47 +216,87 @@ type Server struct {
 	// The server backend.
 	Backend Backend
 
-	caps  []string
-	auths map[string]SaslServerFactory
-	done  chan struct{}
+	caps      []string
+	auths     map[string]SaslServerFactory
+	authMechs []string // in registration order
+	done      chan struct{}
 
 	locker    sync.Mutex
 	listeners []net.Listener
 	conns     map[*Conn]struct{}
+	closed    bool
 }
 
 // New creates a new SMTP server.
+//
+// The PLAIN and LOGIN authentication mechanisms are enabled, and authenticate
+// users with Session.AuthPlain.
 func NewServer(be Backend) *Server {
-	return &Server{
+	s := &Server{
 		// Doubled maximum line length per RFC 5321 (Section 4.5.3.1.6)
 		MaxLineLength: 2000,
 
+		EnableEnhancedStatusCodes: true,
+
 		Backend:  be,
 		done:     make(chan struct{}, 1),
 		ErrorLog: log.New(os.Stderr, "smtp/server ", log.LstdFlags),
-		caps:     []string{"PIPELINING", "8BITMIME", "ENHANCEDSTATUSCODES", "CHUNKING"},
-		auths: map[string]SaslServerFactory{
-			sasl.Plain: func(conn *Conn) sasl.Server {
-				return sasl.NewPlainServer(func(identity, username, password string) error {
-					if identity != "" && identity != username {
-						return errors.New("Identities not supported")
-					}
-
-					sess := conn.Session()
-					if sess == nil {
-						panic("No session when AUTH is called")
-					}
-
-					return sess.AuthPlain(username, password)
-				})
-			},
-		},
-		conns: make(map[*Conn]struct{}),
+		caps:     []string{"PIPELINING", "8BITMIME", "CHUNKING"},
+		auths:    make(map[string]SaslServerFactory),
+		conns:    make(map[*Conn]struct{}),
+	}
+
+	s.EnableAuth(sasl.Plain, func(conn *Conn) sasl.Server {
+		return sasl.NewPlainServer(func(identity, username, password string) error {
+			if identity != "" && identity != username {
+				return errors.New("Identities not supported")
+			}
+			return authPlain(conn, username, password)
+		})
+	})
+	s.EnableAuth(sasl.Login, func(conn *Conn) sasl.Server {
+		return sasl.NewLoginServer(func(username, password string) error {
+			return authPlain(conn, username, password)
+		})
+	})
+
+	return s
+}
+
+func authPlain(conn *Conn, username, password string) error {
+	sess := conn.Session()
+	if sess == nil {
+		panic("No session when AUTH is called")
+	}
+
+	if err := sess.AuthPlain(username, password); err != nil {
+		return err
 	}
+	conn.SetAuthenticatedUser(username)
+	return nil
 }
 
 // Serve accepts incoming connections on the Listener l.
 func (s *Server) Serve(l net.Listener) error {
+	if strings.ContainsAny(s.Domain, "\r\n") {
+		return errors.New("smtp: Server.Domain must not contain CR or LF")
+	}
+	if strings.ContainsAny(s.Banner, "\r\n") {
+		return errors.New("smtp: Server.Banner must not contain CR or LF")
+	}
+	for _, name := range s.DisabledCommands {
+		cmd := strings.ToUpper(name)
+		if !disableableCommands[cmd] && !unimplementedCommands[cmd] {
+			return fmt.Errorf("smtp: command %q in Server.DisabledCommands can't be disabled", name)
+		}
+	}
+	if s.EnableBINARYMIME && !s.chunking() {
+		return errors.New("smtp: Server.EnableBINARYMIME requires the CHUNKING capability")
+	}
+	if strings.Contains(s.HelpText, "\r") {
+		return errors.New("smtp: Server.HelpText must not contain CR")
+	}
+
 	s.locker.Lock()
 	s.listeners = append(s.listeners, l)
 	s.locker.Unlock()
@@ -117,41 +309,102 @@ func (s *Server) Serve(l net.Listener) error {
 				// we called Close()
 				return nil
 			default:
+				s.logError("accept error", "error", err)
 				return err
 			}
 		}
 
-		go s.handleConn(newConn(c, s))
+		// The connection is tracked before Serve accepts the next one, so
+		// that Shutdown doesn't miss it
+		conn := newConn(c, s)
+		s.locker.Lock()
+		if s.MaxConnections > 0 && len(s.conns) >= s.MaxConnections {
+			s.locker.Unlock()
+			go conn.rejectTooManyConns()
+			continue
+		}
+		s.conns[conn] = struct{}{}
+		s.locker.Unlock()
+
+		go s.handleConn(conn)
 	}
 }
 
 func (s *Server) handleConn(c *Conn) error {
-	s.locker.Lock()
-	s.conns[c] = struct{}{}
-	s.locker.Unlock()
-
+	// Reason passed to the session when the connection is closed
+	reason := errConnClosed
 	defer func() {
-		c.Close()
+		if err := recover(); err != nil {
+			c.WriteResponse(421, EnhancedCode{4, 0, 0}, "Internal server error")
+			reason = fmt.Errorf("smtp: panic: %v", err)
+			c.logError("panic serving connection", "error", err, "stack", string(debug.Stack()))
+		}
+
+		c.close(reason)
 
 		s.locker.Lock()
 		delete(s.conns, c)
 		s.locker.Unlock()
 	}()
 
-	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+	tlsConn, isTLS := c.conn.(*tls.Conn)
+	if isTLS {
 		if d := s.ReadTimeout; d != 0 {
 			c.conn.SetReadDeadline(time.Now().Add(d))
 		}
 		if d := s.WriteTimeout; d != 0 {
 			c.conn.SetWriteDeadline(time.Now().Add(d))
 		}
+	}
+
+	if s.EnableProxyProtocol {
+		if isTLS {
+			s.logError("invalid configuration", "error", errTLSAndProxy)
+			return errTLSAndProxy
+		}
+		if d := s.ReadTimeout; d != 0 {
+			c.conn.SetReadDeadline(time.Now().Add(d))
+		}
+		src, dst, err := readProxyHeader(c.conn)
+		if err != nil {
+			c.logError("PROXY protocol error", "error", err)
+			return err
+		}
+		c.proxySrc, c.proxyDst = src, dst
+	}
+
+	// Check the connection before doing any expensive work, such as the TLS
+	// handshake
+	if s.ConnectionChecker != nil {
+		if err := s.ConnectionChecker(c.State().RemoteAddr); err != nil {
+			c.rejectGreeting(err)
+			return err
+		}
+	}
+	if be, ok := s.Backend.(GreetingBackend); ok {
+		if err := be.CheckConnection(c.State()); err != nil {
+			c.rejectGreeting(err)
+			return err
+		}
+	}
+
+	if isTLS {
 		if err := tlsConn.Handshake(); err != nil {
-			s.ErrorLog.Printf("TLS handshake error for %s: %v", tlsConn.RemoteAddr(), err)
+			c.logError("TLS handshake error", "error", err)
 			return err
 		}
 	}
 
+	if err := c.delayGreeting(); err != nil {
+		reason = err
+		if err == errEarlyTalker {
+			c.protocolError(554, NoEnhancedCode, "SMTP protocol violation")
+		}
+		return err
+	}
+
 	c.greet()
+	c.lastActivity = time.Now()
 
 	for {
 		line, err := c.ReadLine()
@@ -162,8 +415,17 @@ func (s *Server) handleConn(c *Conn) error {
 				continue
 			}
 
+			// Idle time is counted between command lines
+			if !strings.EqualFold(cmd, "NOOP") {
+				c.lastActivity = time.Now()
+			}
 			c.handle(cmd, arg)
+			// Receiving a message body is activity as well
+			if strings.EqualFold(cmd, "DATA") || strings.EqualFold(cmd, "BDAT") {
+				c.lastActivity = time.Now()
+			}
 		} else {
+			reason = err
 			if err == io.EOF {
 				return nil
 			}
@@ -173,7 +435,7 @@ func (s *Server) handleConn(c *Conn) error {
 			}
 
 			if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
-				c.WriteResponse(221, EnhancedCode{2, 4, 2}, "Idle timeout, bye bye")
+				c.WriteResponse(421, EnhancedCode{4, 4, 2}, "Idle timeout, closing connection")
 				return nil
 			}
 
@@ -183,6 +445,20 @@ func (s *Server) handleConn(c *Conn) error {
 	}
 }
 
+func (s *Server) logError(msg string, args ...interface{}) {
+	if s.Logger != nil {
+		s.Logger.Error(msg, args...)
+		return
+	}
+
+	var sb strings.Builder
+	sb.WriteString(msg)
+	for i := 0; i+1 < len(args); i += 2 {
+		fmt.Fprintf(&sb, " %v=%v", args[i], args[i+1])
+	}
+	s.ErrorLog.Println(sb.String())
+}
+
 // ListenAndServe listens on the network address s.Addr and then calls Serve
 // to handle requests on incoming connections.
 //
@@ -214,13 +490,16 @@ func (s *Server) ListenAndServeTLS() error {
 	if s.LMTP {
 		return errTCPAndLMTP
 	}
+	if s.EnableProxyProtocol {
+		return errTLSAndProxy
+	}
 
 	addr := s.Addr
 	if addr == "" {
 		addr = ":smtps"
 	}
 
-	l, err := tls.Listen("tcp", addr, s.TLSConfig)
+	l, err := tls.Listen("tcp", addr, s.tlsConfig())
 	if err != nil {
 		return err
 	}
@@ -228,42 +507,208 @@ func (s *Server) ListenAndServeTLS() error {
 	return s.Serve(l)
 }
 
+// tlsConfig returns the TLS configuration for incoming connections, taking
+// TLSConfigForHost into account.
+func (s *Server) tlsConfig() *tls.Config {
+	if len(s.TLSConfigForHost) == 0 || s.TLSConfig == nil {
+		return s.TLSConfig
+	}
+
+	config := s.TLSConfig.Clone()
+	getConfigForClient := config.GetConfigForClient
+	config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		host := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+		if hostConfig, ok := s.TLSConfigForHost[host]; ok {
+			return hostConfig, nil
+		}
+		if getConfigForClient != nil {
+			return getConfigForClient(hello)
+		}
+		return nil, nil
+	}
+	return config
+}
+
+// disableableCommands lists the commands which can be part of
+// Server.DisabledCommands.
+var disableableCommands = map[string]bool{
+	"VRFY":     true,
+	"EXPN":     true,
+	"HELP":     true,
+	"NOOP":     true,
+	"STARTTLS": true,
+	"AUTH":     true,
+	"BDAT":     true,
+	"XCLIENT":  true,
+}
+
+// unimplementedCommands lists the commands which are recognized but always
+// rejected with a 502 reply.
+var unimplementedCommands = map[string]bool{
+	"SEND": true,
+	"SOML": true,
+	"SAML": true,
+	"TURN": true,
+	"ETRN": true,
+}
+
+// commandDisabled reports whether cmd is part of DisabledCommands.
+func (s *Server) commandDisabled(cmd string) bool {
+	for _, name := range s.DisabledCommands {
+		if strings.EqualFold(name, cmd) {
+			return true
+		}
+	}
+	return false
+}
+
+// chunking reports whether the CHUNKING capability is advertised.
+func (s *Server) chunking() bool {
+	if s.commandDisabled("BDAT") {
+		return false
+	}
+	for _, name := range s.caps {
+		if name == "CHUNKING" {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) resolver() Resolver {
+	if s.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return s.Resolver
+}
+
 // Close immediately closes all active listeners and connections.
 //
 // Close returns any error returned from closing the server's underlying
 // listener(s).
 func (s *Server) Close() error {
-	select {
-	case <-s.done:
+	s.locker.Lock()
+	defer s.locker.Unlock()
+
+	if s.closed {
 		return errors.New("smtp: server already closed")
-	default:
-		close(s.done)
 	}
+	s.closed = true
 
-	var err error
+	err := s.closeListeners()
+	for conn := range s.conns {
+		conn.close(errServerShutdown)
+	}
+
+	return err
+}
+
+// Shutdown gracefully shuts down the server without interrupting any
+// in-flight mail transaction. Shutdown first closes all active listeners, then
+// waits for all connections to be closed. During the shutdown, new HELO, EHLO,
+// LHLO and MAIL commands are rejected with a 421 reply which closes the
+// connection.
+//
+// If ctx is done before all connections have been closed, Shutdown closes the
+// remaining ones and returns the context's error. Otherwise, it returns any
+// error returned from closing the server's underlying listener(s).
+func (s *Server) Shutdown(ctx context.Context) error {
 	s.locker.Lock()
+	if s.shuttingDown() {
+		s.locker.Unlock()
+		return errors.New("smtp: server already closed")
+	}
+	lnerr := s.closeListeners()
+	s.locker.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		s.locker.Lock()
+		n := len(s.conns)
+		s.locker.Unlock()
+		if n == 0 {
+			return lnerr
+		}
+
+		select {
+		case <-ctx.Done():
+			s.locker.Lock()
+			for conn := range s.conns {
+				conn.close(errServerShutdown)
+			}
+			s.locker.Unlock()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeListeners stops accepting new connections. It must be called with
+// s.locker held.
+func (s *Server) closeListeners() error {
+	if s.shuttingDown() {
+		// Already done by Shutdown
+		return nil
+	}
+	close(s.done)
+
+	var err error
 	for _, l := range s.listeners {
 		if lerr := l.Close(); lerr != nil && err == nil {
 			err = lerr
 		}
 	}
+	return err
+}
 
-	for conn := range s.conns {
-		conn.Close()
+// shuttingDown reports whether Close or Shutdown has been called.
+func (s *Server) shuttingDown() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
 	}
-	s.locker.Unlock()
-
-	return err
 }
 
-// EnableAuth enables an authentication mechanism on this server.
+// EnableAuth enables an authentication mechanism on this server. It can be
+// used to register custom SASL mechanisms, or to replace a built-in one. The
+// mechanism name is case-insensitive.
 //
-// This function should not be called directly, it must only be used by
-// libraries implementing extensions of the SMTP protocol.
+// Mechanisms are advertised in the order they are enabled. EnableAuth must be
+// called before the server starts accepting connections.
 func (s *Server) EnableAuth(name string, f SaslServerFactory) {
+	name = strings.ToUpper(name)
+	if _, ok := s.auths[name]; !ok {
+		s.authMechs = append(s.authMechs, name)
+	}
 	s.auths[name] = f
 }
 
+// DisableAuth disables an authentication mechanism on this server, e.g. the
+// obsolete LOGIN mechanism. The mechanism name is case-insensitive.
+func (s *Server) DisableAuth(name string) {
+	name = strings.ToUpper(name)
+	if _, ok := s.auths[name]; !ok {
+		return
+	}
+	delete(s.auths, name)
+	for i, mech := range s.authMechs {
+		if mech == name {
+			s.authMechs = append(s.authMechs[:i], s.authMechs[i+1:]...)
+			break
+		}
+	}
+}
+
+// ActiveConnections returns the number of opened connections.
+func (s *Server) ActiveConnections() int {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	return len(s.conns)
+}
+
 // ForEachConn iterates through all opened connections.
 func (s *Server) ForEachConn(f func(*Conn)) {
 	s.locker.Lock()
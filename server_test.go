@@ -2,22 +2,41 @@ package smtp_test
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"net"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/emersion/go-sasl"
 	"github.com/emersion/go-smtp"
 )
 
 type message struct {
-	From string
-	To   []string
-	Data []byte
-	Opts *smtp.MailOptions
+	From     string
+	To       []string
+	RcptOpts []*smtp.RcptOptions
+	Data     []byte
+	Opts     *smtp.MailOptions
 }
 
 type backend struct {
@@ -40,14 +59,43 @@ type backend struct {
 	// Read N bytes of message before returning dataErr.
 	dataErrOffset int64
 
-	panicOnMail bool
-	userErr     error
+	panicOnMail   bool
+	panicOnData   bool
+	panicOnLogout bool
+	userErr       error
+
+	// Connection state passed to the last NewSession call.
+	state smtp.ConnectionState
+
+	// Error returned by NewSession.
+	sessionErr error
+
+	// Reasons passed to LogoutWithReason.
+	logoutReasons chan error
+
+	// Queue ID returned by DataWithQueueID.
+	queueID string
+
+	// Credentials accepted by AuthPlain, in addition to username/password.
+	users map[string]string
+
+	// Mailing lists returned by Expand, also used by Verify. Sessions only
+	// implement VerifySession and ExpandSession if set.
+	lists map[string][]string
 }
 
-func (be *backend) NewSession(_ smtp.ConnectionState, _ string) (smtp.Session, error) {
+func (be *backend) NewSession(state smtp.ConnectionState, _ string) (smtp.Session, error) {
+	be.state = state
+	if be.sessionErr != nil {
+		return nil, be.sessionErr
+	}
+
 	if be.implementLMTPData {
 		return &lmtpSession{&session{backend: be, anonymous: true}}, nil
 	}
+	if be.lists != nil {
+		return &vrfySession{&session{backend: be, anonymous: true}}, nil
+	}
 
 	return &session{backend: be, anonymous: true}, nil
 }
@@ -56,6 +104,40 @@ type lmtpSession struct {
 	*session
 }
 
+type vrfySession struct {
+	*session
+}
+
+func (s *vrfySession) Verify(addr string) error {
+	for _, members := range s.backend.lists {
+		for _, member := range members {
+			if member == addr {
+				return nil
+			}
+		}
+	}
+	return &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "No such user",
+	}
+}
+
+func (s *vrfySession) Expand(list string) ([]string, error) {
+	if list == "broken" {
+		return nil, errors.New("directory unavailable")
+	}
+	members, ok := s.backend.lists[list]
+	if !ok {
+		return nil, &smtp.SMTPError{
+			Code:         550,
+			EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+			Message:      "No such list",
+		}
+	}
+	return members, nil
+}
+
 type session struct {
 	backend   *backend
 	anonymous bool
@@ -64,6 +146,10 @@ type session struct {
 }
 
 func (s *session) AuthPlain(username, password string) error {
+	if pass, ok := s.backend.users[username]; ok && pass == password {
+		s.anonymous = false
+		return nil
+	}
 	if username != "username" || password != "password" {
 		return errors.New("Invalid username or password")
 	}
@@ -79,6 +165,16 @@ func (s *session) Logout() error {
 	return nil
 }
 
+func (s *session) LogoutWithReason(reason error) error {
+	if s.backend.panicOnLogout {
+		panic("Everything is on fire!")
+	}
+	if s.backend.logoutReasons != nil {
+		s.backend.logoutReasons <- reason
+	}
+	return nil
+}
+
 func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 	if s.backend.userErr != nil {
 		return s.backend.userErr
@@ -93,11 +189,19 @@ func (s *session) Mail(from string, opts *smtp.MailOptions) error {
 }
 
 func (s *session) Rcpt(to string) error {
+	return s.RcptWithOptions(to, &smtp.RcptOptions{})
+}
+
+func (s *session) RcptWithOptions(to string, opts *smtp.RcptOptions) error {
 	s.msg.To = append(s.msg.To, to)
+	s.msg.RcptOpts = append(s.msg.RcptOpts, opts)
 	return nil
 }
 
 func (s *session) Data(r io.Reader) error {
+	if s.backend.panicOnData {
+		panic("Everything is on fire!")
+	}
 	if s.backend.dataErr != nil {
 
 		if s.backend.dataErrOffset != 0 {
@@ -130,6 +234,13 @@ func (s *session) Data(r io.Reader) error {
 	return nil
 }
 
+func (s *session) DataWithQueueID(r io.Reader) (string, error) {
+	if err := s.Data(r); err != nil {
+		return "", err
+	}
+	return s.backend.queueID, nil
+}
+
 func (s *session) LMTPData(r io.Reader, collector smtp.StatusCollector) error {
 	if err := s.Data(r); err != nil {
 		return err
@@ -196,7 +307,7 @@ func testServerEhlo(t *testing.T, fn ...serverConfigureFunc) (be *backend, s *sm
 	io.WriteString(c, "EHLO localhost\r\n")
 
 	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
+	if scanner.Text() != "250-localhost Hello localhost" {
 		t.Fatal("Invalid EHLO response:", scanner.Text())
 	}
 
@@ -241,7 +352,7 @@ func TestServer_helo(t *testing.T) {
 func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
 	be, s, c, scanner, caps := testServerEhlo(t)
 
-	if _, ok := caps["AUTH PLAIN"]; !ok {
+	if _, ok := caps["AUTH PLAIN LOGIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
 	}
 
@@ -260,10 +371,144 @@ func testServerAuthenticated(t *testing.T) (be *backend, s *smtp.Server, c net.C
 	return
 }
 
+// testTLSConfig returns a TLS configuration with a self-signed certificate
+// for localhost.
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+// testServerStartTLS upgrades c to TLS with STARTTLS and issues EHLO again.
+func testServerStartTLS(t *testing.T, c net.Conn, scanner *bufio.Scanner) (tc *tls.Conn, tscanner *bufio.Scanner, caps map[string]bool) {
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tc = tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal("TLS handshake failed:", err)
+	}
+	tscanner = bufio.NewScanner(tc)
+
+	io.WriteString(tc, "EHLO localhost\r\n")
+	caps = make(map[string]bool)
+	for tscanner.Scan() {
+		s := tscanner.Text()
+		if !strings.HasPrefix(s, "250") {
+			t.Fatal("Invalid EHLO response:", s)
+		}
+		caps[s[4:]] = true
+		if strings.HasPrefix(s, "250 ") {
+			break
+		}
+	}
+
+	return tc, tscanner, caps
+}
+
+// cramMD5Server implements the server side of the CRAM-MD5 mechanism, as
+// described in RFC 2195.
+type cramMD5Server struct {
+	challenge string
+	secrets   map[string]string
+	sess      smtp.Session
+}
+
+func (a *cramMD5Server) Next(response []byte) (challenge []byte, done bool, err error) {
+	if response == nil {
+		return []byte(a.challenge), false, nil
+	}
+
+	parts := strings.SplitN(string(response), " ", 2)
+	if len(parts) != 2 {
+		return nil, true, errors.New("Invalid CRAM-MD5 response")
+	}
+	d := hmac.New(md5.New, []byte(a.secrets[parts[0]]))
+	d.Write([]byte(a.challenge))
+	if !hmac.Equal([]byte(hex.EncodeToString(d.Sum(nil))), []byte(parts[1])) {
+		return nil, true, errors.New("Invalid username or password")
+	}
+	return nil, true, a.sess.AuthPlain(parts[0], "password")
+}
+
+func TestServerEnableAuth(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.DisableAuth(sasl.Login)
+		s.EnableAuth("cram-md5", func(conn *smtp.Conn) sasl.Server {
+			return &cramMD5Server{
+				challenge: "<1896.697170952@postoffice.example.net>",
+				secrets:   map[string]string{"username": "tanstaaftanstaaf"},
+				sess:      conn.Session(),
+			}
+		})
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["AUTH PLAIN CRAM-MD5"] {
+		t.Fatal("Invalid AUTH capability:", caps)
+	}
+
+	io.WriteString(c, "AUTH CRAM-MD5\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 "+base64.StdEncoding.EncodeToString([]byte("<1896.697170952@postoffice.example.net>")) {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	d := hmac.New(md5.New, []byte("tanstaaftanstaaf"))
+	d.Write([]byte("<1896.697170952@postoffice.example.net>"))
+	resp := "username " + hex.EncodeToString(d.Sum(nil))
+	io.WriteString(c, base64.StdEncoding.EncodeToString([]byte(resp))+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
+func TestServerAuthLogin(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "AUTH LOGIN\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 VXNlcm5hbWU6" {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(c, "dXNlcm5hbWU=\r\n")
+	scanner.Scan()
+	if scanner.Text() != "334 UGFzc3dvcmQ6" {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(c, "cGFzc3dvcmQ=\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+}
+
 func TestServerAuthTwice(t *testing.T) {
 	_, _, c, scanner, caps := testServerEhlo(t)
 
-	if _, ok := caps["AUTH PLAIN"]; !ok {
+	if _, ok := caps["AUTH PLAIN LOGIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
 	}
 
@@ -295,7 +540,7 @@ func TestServerAuthTwice(t *testing.T) {
 func TestServerCancelSASL(t *testing.T) {
 	_, _, c, scanner, caps := testServerEhlo(t)
 
-	if _, ok := caps["AUTH PLAIN"]; !ok {
+	if _, ok := caps["AUTH PLAIN LOGIN"]; !ok {
 		t.Fatal("AUTH PLAIN capability is missing when auth is enabled")
 	}
 
@@ -352,6 +597,198 @@ func TestServerPanicRecover(t *testing.T) {
 	}
 }
 
+type logEntry struct {
+	level string
+	msg   string
+	args  map[string]interface{}
+}
+
+type testLogger struct {
+	locker  sync.Mutex
+	entries []logEntry
+}
+
+func (l *testLogger) log(level, msg string, args []interface{}) {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+
+	e := logEntry{level: level, msg: msg, args: make(map[string]interface{})}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.args[args[i].(string)] = args[i+1]
+	}
+	l.entries = append(l.entries, e)
+}
+
+func (l *testLogger) Error(msg string, args ...interface{}) {
+	l.log("error", msg, args)
+}
+
+func (l *testLogger) Warn(msg string, args ...interface{}) {
+	l.log("warn", msg, args)
+}
+
+func (l *testLogger) Entries() []logEntry {
+	l.locker.Lock()
+	defer l.locker.Unlock()
+	return append([]logEntry(nil), l.entries...)
+}
+
+func TestServer_Logger(t *testing.T) {
+	logger := new(testLogger)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Logger = logger
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "FOOB\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid FOOB response:", scanner.Text())
+	}
+
+	be.panicOnMail = true
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	entries := logger.Entries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 log entries, got %v", entries)
+	}
+	if e := entries[0]; e.level != "warn" || e.args["command"] != "FOOB" || e.args["code"] != 500 || e.args["remote_addr"] == nil || e.args["session_id"] == "" {
+		t.Fatalf("Invalid protocol error log entry: %+v", e)
+	}
+	if e := entries[1]; e.level != "error" || e.args["command"] != "MAIL" || e.args["error"] == nil || e.args["remote_addr"] == nil {
+		t.Fatalf("Invalid panic log entry: %+v", e)
+	}
+}
+
+type syncBuffer struct {
+	locker sync.Mutex
+	buf    bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.locker.Lock()
+	defer b.locker.Unlock()
+	return b.buf.String()
+}
+
+func TestServer_SessionID(t *testing.T) {
+	debug := new(syncBuffer)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Debug = debug
+	})
+	defer s.Close()
+	defer c.Close()
+
+	id := be.state.SessionID
+	if id == "" {
+		t.Fatal("Empty session ID")
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+
+	if !strings.Contains(debug.String(), id+" C: NOOP\r\n") {
+		t.Fatalf("Debug output doesn't contain the session ID: %q", debug.String())
+	}
+	if !strings.Contains(debug.String(), id+" S: 250 ") {
+		t.Fatalf("Debug output doesn't contain the session ID: %q", debug.String())
+	}
+
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	io.WriteString(c2, "HELO localhost\r\n")
+	scanner2.Scan()
+
+	if be.state.SessionID == "" || be.state.SessionID == id {
+		t.Fatalf("Expected a new unique session ID, got %q", be.state.SessionID)
+	}
+}
+
+func TestServerPanicRecover_Data(t *testing.T) {
+	logger := new(testLogger)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Logger = logger
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.panicOnData = true
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<bob@wonderland.book>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed after panic:", scanner.Text())
+	}
+
+	entries := logger.Entries()
+	if len(entries) != 1 || entries[0].args["session_id"] != be.state.SessionID || entries[0].args["command"] != "DATA" {
+		t.Fatalf("Invalid log entries: %+v", entries)
+	}
+
+	// The server must still accept connections
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner2.Text())
+	}
+}
+
+func TestServerPanicRecover_Logout(t *testing.T) {
+	logger := new(testLogger)
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Logger = logger
+	})
+	defer s.Close()
+	defer c.Close()
+
+	be.panicOnLogout = true
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Connection not closed after QUIT:", scanner.Text())
+	}
+
+	entries := logger.Entries()
+	if len(entries) != 1 || entries[0].msg != "panic serving connection" {
+		t.Fatalf("Invalid log entries: %+v", entries)
+	}
+}
+
 func TestServerSMTPUTF8(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	s.EnableSMTPUTF8 = true
@@ -389,6 +826,72 @@ func TestServer8BITMIME(t *testing.T) {
 	}
 }
 
+func TestServer_BODY(t *testing.T) {
+	for _, tc := range []struct {
+		arg  string
+		body smtp.BodyType
+	}{
+		{"", ""},
+		{" BODY=7BIT", smtp.Body7Bit},
+		{" BODY=8BITMIME", smtp.Body8BitMIME},
+		{" BODY=8bitmime", smtp.Body8BitMIME},
+	} {
+		be, s, c, scanner, caps := testServerEhlo(t)
+		if !caps["8BITMIME"] {
+			t.Fatal("8BITMIME capability is missing")
+		}
+
+		io.WriteString(c, "MAIL FROM:<alice@wonderland.book>"+tc.arg+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid MAIL response:", scanner.Text())
+		}
+		io.WriteString(c, "RCPT TO:<bob@wonderland.book>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+
+		if len(be.anonmsgs) != 1 {
+			t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+		}
+		if body := be.anonmsgs[0].Opts.Body; body != tc.body {
+			t.Errorf("MAIL FROM:<...>%v: got body type %q, want %q", tc.arg, body, tc.body)
+		}
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_InvalidAddress(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<alice@wonder\rland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.1.7 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<bob@wonder\rland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "501 5.1.3 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
 func TestServer_BODYInvalidValue(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -396,7 +899,7 @@ func TestServer_BODYInvalidValue(t *testing.T) {
 
 	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> BODY=RABIIT\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
 }
@@ -437,6 +940,48 @@ func TestServerTooBig(t *testing.T) {
 	}
 }
 
+func TestServer_SIZE(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxMessageBytes = 1024
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["SIZE 1024"] {
+		t.Fatal("Missing capability: SIZE 1024")
+	}
+
+	for _, size := range []string{"1025", "4294967296", "99999999999999999999"} {
+		io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE="+size+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "552 5.3.4 ") {
+			t.Fatalf("Invalid MAIL response for SIZE=%v: %v", size, scanner.Text())
+		}
+	}
+
+	io.WriteString(c, "MAIL FROM:<alice@wonderland.book> SIZE=1024\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<bob@wonderland.book>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	if size := be.anonmsgs[0].Opts.Size; size != 1024 {
+		t.Errorf("Got SIZE %v, want 1024", size)
+	}
+}
+
 func TestServerEmptyTo(t *testing.T) {
 	_, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
@@ -553,7 +1098,7 @@ func TestServer_authDisabled(t *testing.T) {
 	defer s.Close()
 	defer c.Close()
 
-	if _, ok := caps["AUTH PLAIN"]; ok {
+	if _, ok := caps["AUTH PLAIN LOGIN"]; ok {
 		t.Fatal("AUTH PLAIN capability is present when auth is disabled")
 	}
 
@@ -645,509 +1190,2559 @@ func TestServer_tooLongMessage(t *testing.T) {
 	}
 }
 
-func TestServer_tooLongLine(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
+func TestServer_maxSizeMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+strings.Repeat("A", 2000))
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "500 ") {
-		t.Fatal("Invalid response, expected an error but got:", scanner.Text())
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "This message is exactly as long as the limit!!!!\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
 	}
 }
 
-func TestServer_anonymousUserError(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServer_tooLongMessage_ignoredError(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
-	defer c.Close()
 
-	be.userErr = smtp.ErrAuthRequired
+	s.MaxMessageBytes = 50
+	// The backend reads past the limit and returns its own error
+	be.dataErr = errors.New("failed to read the message")
+	be.dataErrOffset = 100
 
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if scanner.Text() != "502 5.7.0 Please authenticate first" {
-		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "This is a very long message.\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	// The connection must still be in sync
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 }
 
-func TestServer_anonymousUserOK(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServer_contentFilter(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
-	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	// The backend scans the beginning of the message and rejects it
+	be.dataErr = fmt.Errorf("scanner: %w", &smtp.SMTPError{
+		Code:         554,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Rejected by content filter",
+	})
+	be.dataErrOffset = 10
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
+
+	io.WriteString(c, "Subject: Buy now\r\n")
+	io.WriteString(c, "\r\n")
+	io.WriteString(c, strings.Repeat("Cheap stuff!\r\n", 1000))
 	io.WriteString(c, ".\r\n")
 	scanner.Scan()
-
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
+	if scanner.Text() != "554 5.7.1 Rejected by content filter" {
 		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	// The rest of the message has been discarded
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 }
 
-func TestServer_authParam(t *testing.T) {
-	be, s, c, scanner, _ := testServerEhlo(t)
+func TestServer_pipelining(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
 	defer s.Close()
-	defer c.Close()
 
-	// Invalid HEXCHAR
-	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+A>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "500 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
-	}
+	// The whole group is sent in a single write
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n"+
+		"RCPT TO:<root@gchq.gov.uk>\r\n"+
+		"RCPT TO:\r\n"+
+		"RCPT TO:<root@bnd.bund.de>\r\n"+
+		"DATA\r\n")
 
-	// Invalid HEXCHAR
-	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<he+YYa>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "500 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	expected := []string{"250 ", "250 ", "501 ", "250 ", "354 "}
+	for i, prefix := range expected {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), prefix) {
+			t.Fatalf("Invalid response #%v, expected %q but got: %v", i, prefix, scanner.Text())
+		}
 	}
 
-	// https://tools.ietf.org/html/rfc4954#section-4
-	// >servers that advertise support for this
-	// >extension MUST support the AUTH parameter to the MAIL FROM
-	// >command even when the client has not authenticated itself to the
-	// >server.
-	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+3Da>\r\n")
+	io.WriteString(c, "Hey <3\r\n.\r\nQUIT\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
 	}
 
-	// Go on as usual.
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if to := be.messages[0].To; len(to) != 2 || to[0] != "root@gchq.gov.uk" || to[1] != "root@bnd.bund.de" {
+		t.Fatal("Invalid message recipients:", to)
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
 	scanner.Scan()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Fatal("Shutdown returned before the transaction was complete:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if _, err := net.Dial("tcp", c.RemoteAddr().String()); err == nil {
+		t.Fatal("Expected the listener to be closed")
+	}
+
+	// The in-flight transaction can be completed
 	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
-	io.WriteString(c, "Hey <3\r\n")
-	io.WriteString(c, ".\r\n")
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+	io.WriteString(c, "Hey <3\r\n.\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	// But new ones are rejected
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
-	if val := be.anonmsgs[0].Opts.Auth; val == nil || *val != "hey=a" {
-		t.Fatal("Invalid Auth value:", val)
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal("Shutdown failed:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown didn't return after the connection was closed")
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
 	}
 }
 
-func testStrictServer(t *testing.T) (s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
-	l, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		t.Fatal(err)
+func TestServer_ShutdownTimeout(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatal("Expected Shutdown to time out, got:", err)
 	}
 
-	s = smtp.NewServer(new(backend))
-	s.Domain = "localhost"
-	s.AllowInsecureAuth = true
-	s.AuthDisabled = true
-	s.Strict = true
+	// The idle connection has been closed
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
 
-	go s.Serve(l)
+func TestServer_MaxConnections(t *testing.T) {
+	_, s, c, _ := testServerGreeted(t, func(s *smtp.Server) {
+		s.MaxConnections = 2
+	})
+	defer s.Close()
+	defer c.Close()
 
-	c, err = net.Dial("tcp", l.Addr().String())
+	c2, err := net.Dial("tcp", c.RemoteAddr().String())
 	if err != nil {
 		t.Fatal(err)
 	}
+	defer c2.Close()
+	scanner2 := bufio.NewScanner(c2)
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner2.Text())
+	}
 
-	scanner = bufio.NewScanner(c)
+	c3, err := net.Dial("tcp", c.RemoteAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c3.Close()
+	scanner3 := bufio.NewScanner(c3)
+	scanner3.Scan()
+	if !strings.HasPrefix(scanner3.Text(), "421 ") {
+		t.Fatal("Invalid greeting, expected a rejection but got:", scanner3.Text())
+	}
+	if scanner3.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner3.Text())
+	}
 
-	scanner.Scan()
-	if scanner.Text() != "220 localhost ESMTP Service Ready" {
-		t.Fatal("Invalid greeting:", scanner.Text())
+	if n := s.ActiveConnections(); n != 2 {
+		t.Fatal("Invalid number of active connections:", n)
 	}
+}
 
-	io.WriteString(c, "EHLO localhost\r\n")
+func TestServer_ConnectionChecker(t *testing.T) {
+	tests := []struct {
+		err      error
+		greeting string
+	}{
+		{
+			err: &smtp.SMTPError{
+				Code:    421,
+				Message: "Too many connections from your IP",
+			},
+			greeting: "421 Too many connections from your IP",
+		},
+		{
+			err:      errors.New("denylisted"),
+			greeting: "554 Connection rejected",
+		},
+	}
+	for _, test := range tests {
+		var remoteAddr net.Addr
+		_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+			s.ConnectionChecker = func(addr net.Addr) error {
+				remoteAddr = addr
+				return test.err
+			}
+		})
 
-	scanner.Scan()
-	if scanner.Text() != "250-Hello localhost" {
-		t.Fatal("Invalid EHLO response:", scanner.Text())
+		scanner.Scan()
+		if scanner.Text() != test.greeting {
+			t.Errorf("Invalid greeting: got %q, want %q", scanner.Text(), test.greeting)
+		}
+		if scanner.Scan() {
+			t.Error("Expected the connection to be closed, got:", scanner.Text())
+		}
+		if remoteAddr == nil || remoteAddr.String() != c.LocalAddr().String() {
+			t.Errorf("Invalid remote address: got %v, want %v", remoteAddr, c.LocalAddr())
+		}
+
+		c.Close()
+		s.Close()
 	}
+}
 
-	expectedCaps := []string{"PIPELINING", "8BITMIME"}
-	caps := make(map[string]bool)
+func TestServer_ProxyProtocol(t *testing.T) {
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c" +
+		"\xc0\x00\x02\x01\xc6\x33\x64\x02\x30\x39\x00\x19")
+	tests := []struct {
+		name   string
+		header string
+		addr   string
+	}{
+		{"v1", "PROXY TCP4 192.0.2.1 198.51.100.2 12345 25\r\n", "192.0.2.1:12345"},
+		{"v1-ipv6", "PROXY TCP6 2001:db8::1 2001:db8::2 12345 25\r\n", "[2001:db8::1]:12345"},
+		{"v2", string(v2), "192.0.2.1:12345"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			remoteAddrs := make(chan net.Addr, 1)
+			_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+				s.EnableProxyProtocol = true
+				s.ConnectionChecker = func(addr net.Addr) error {
+					remoteAddrs <- addr
+					return nil
+				}
+			})
+			defer s.Close()
+			defer c.Close()
+
+			io.WriteString(c, test.header)
+			scanner.Scan()
+			if !strings.HasPrefix(scanner.Text(), "220 ") {
+				t.Fatal("Invalid greeting:", scanner.Text())
+			}
+			if addr := <-remoteAddrs; addr.String() != test.addr {
+				t.Errorf("Invalid remote address: got %v, want %v", addr, test.addr)
+			}
+		})
+	}
+}
 
-	for scanner.Scan() {
-		s := scanner.Text()
+func TestServer_ProxyProtocolInvalid(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.EnableProxyProtocol = true
+		s.ErrorLog = log.New(ioutil.Discard, "", 0)
+	})
+	defer s.Close()
+	defer c.Close()
 
-		if strings.HasPrefix(s, "250 ") {
-			caps[strings.TrimPrefix(s, "250 ")] = true
-			break
-		} else {
-			if !strings.HasPrefix(s, "250-") {
-				t.Fatal("Invalid capability response:", s)
-			}
-			caps[strings.TrimPrefix(s, "250-")] = true
-		}
+	io.WriteString(c, "PROXY TCP4 192.0.2.1\r\n")
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_XClient(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		_, localhost, _ := net.ParseCIDR("127.0.0.0/8")
+		s.TrustedXClientNets = []net.IPNet{*localhost}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["XCLIENT NAME ADDR PORT PROTO LOGIN"] {
+		t.Fatal("Missing capability: XCLIENT")
 	}
 
-	for _, cap := range expectedCaps {
-		if !caps[cap] {
-			t.Fatal("Missing capability:", cap)
+	io.WriteString(c, "XCLIENT NAME=mail.example.org ADDR=192.0.2.1 PORT=12345 LOGIN=john+40example.org\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
 		}
 	}
 
-	return
+	if addr := be.state.RemoteAddr.String(); addr != "192.0.2.1:12345" {
+		t.Error("Invalid remote address:", addr)
+	}
+	want := smtp.XClient{Name: "mail.example.org", Login: "john@example.org"}
+	if be.state.XClient == nil || *be.state.XClient != want {
+		t.Errorf("Invalid XCLIENT attributes: got %+v, want %+v", be.state.XClient, want)
+	}
 }
 
-func TestStrictServerGood(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+func TestServer_XClientNoArgs(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		_, localhost, _ := net.ParseCIDR("127.0.0.0/8")
+		s.TrustedXClientNets = []net.IPNet{*localhost}
+	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	io.WriteString(c, "XCLIENT\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "501 5.5.4 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
 	}
 }
 
-func TestStrictServerBad(t *testing.T) {
-	s, c, scanner := testStrictServer(t)
+func TestServer_XClientUntrusted(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		_, trusted, _ := net.ParseCIDR("192.0.2.0/24")
+		s.TrustedXClientNets = []net.IPNet{*trusted}
+	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	for cap := range caps {
+		if strings.HasPrefix(cap, "XCLIENT") {
+			t.Fatal("XCLIENT capability advertised to an untrusted client")
+		}
+	}
+
+	io.WriteString(c, "XCLIENT ADDR=192.0.2.1\r\n")
 	scanner.Scan()
-	if strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "550 ") {
+		t.Fatal("Invalid XCLIENT response:", scanner.Text())
+	}
+
+	if be.state.XClient != nil {
+		t.Fatal("Unexpected XCLIENT attributes:", be.state.XClient)
 	}
 }
 
-func TestServer_Chunking(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_DSN(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableDSN = true
+	})
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	if !caps["DSN"] {
+		t.Fatal("Missing capability: DSN")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=HDRS ENVID=QQ314159+2B1\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
-
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=SUCCESS,DELAY ORCPT=rfc822;george+40example.org\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
 		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
-
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, "RCPT TO:<root@bnd.bund.de> NOTIFY=NEVER,FAILURE\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "501 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
-
-	io.WriteString(c, "BDAT 8 LAST\r\n")
-	io.WriteString(c, "Hey :3\r\n")
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
 	}
-
-	msg := be.messages[0]
-	if msg.From != "root@nsa.gov" {
-		t.Fatal("Invalid mail sender:", msg.From)
+	msg := be.anonmsgs[0]
+	if msg.Opts.Ret != smtp.DSNReturnHeaders || msg.Opts.EnvelopeID != "QQ314159+1" {
+		t.Errorf("Invalid MAIL options: %+v", msg.Opts)
 	}
 	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
-		t.Fatal("Invalid mail recipients:", msg.To)
+		t.Fatal("Invalid recipients:", msg.To)
 	}
-	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
-		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	opts := msg.RcptOpts[0]
+	if len(opts.Notify) != 2 || opts.Notify[0] != smtp.DSNNotifySuccess || opts.Notify[1] != smtp.DSNNotifyDelay {
+		t.Error("Invalid NOTIFY value:", opts.Notify)
+	}
+	if opts.OrigRcpt != "george@example.org" {
+		t.Error("Invalid ORCPT value:", opts.OrigRcpt)
 	}
 }
 
-func TestServer_Chunking_LMTP(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
-	s.LMTP = true
+func TestServer_DSNDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
 	defer s.Close()
 	defer c.Close()
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if caps["DSN"] {
+		t.Fatal("DSN capability advertised but not enabled")
 	}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> RET=FULL\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk> NOTIFY=NEVER\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
 		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
-	io.WriteString(c, "RCPT TO:<toor@gchq.gov.uk>\r\n")
+}
+
+func TestServer_SMTPUTF8(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableSMTPUTF8 = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["SMTPUTF8"] {
+		t.Fatal("Missing capability: SMTPUTF8")
+	}
+
+	// Non-ASCII addresses require the SMTPUTF8 parameter
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
+	io.WriteString(c, "RCPT TO:<δοκιμή@παράδειγμα.δοκιμή>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "550 ") {
 		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, "MAIL FROM:<用户@例子.广告> SMTPUTF8\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
-
-	io.WriteString(c, "BDAT 8 LAST\r\n")
-	io.WriteString(c, "Hey :3\r\n")
+	io.WriteString(c, "RCPT TO:<δοκιμή@παράδειγμα.δοκιμή>\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+		t.Fatal("Invalid RCPT response:", scanner.Text())
 	}
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
 	}
-
-	msg := be.messages[0]
-	if msg.From != "root@nsa.gov" {
-		t.Fatal("Invalid mail sender:", msg.From)
+	msg := be.anonmsgs[0]
+	if msg.From != "用户@例子.广告" || !msg.Opts.UTF8 {
+		t.Errorf("Invalid sender: %v (UTF8: %v)", msg.From, msg.Opts.UTF8)
 	}
-	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
-		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	if len(msg.To) != 1 || msg.To[0] != "δοκιμή@παράδειγμα.δοκιμή" {
+		t.Error("Invalid recipients:", msg.To)
 	}
 }
 
-func TestServer_Chunking_Reset(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_SMTPUTF8Disabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
 	defer s.Close()
 	defer c.Close()
-	be.dataErrors = make(chan error, 10)
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	if caps["SMTPUTF8"] {
+		t.Fatal("SMTPUTF8 capability advertised but not enabled")
+	}
+
+	io.WriteString(c, "MAIL FROM:<用户@例子.广告>\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
+	if !strings.HasPrefix(scanner.Text(), "550 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+func TestServer_EnhancedStatusCodes(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	if !caps["ENHANCEDSTATUSCODES"] {
+		t.Fatal("Missing capability: ENHANCEDSTATUSCODES")
+	}
+
+	io.WriteString(c, "NOOP\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "250 2.0.0 ") {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
+func TestServer_EnhancedStatusCodesHelo(t *testing.T) {
+	_, s, c, scanner := testServerGreeted(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO localhost\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	if scanner.Text() != "250 localhost Hello localhost" {
+		t.Fatal("Invalid HELO response:", scanner.Text())
 	}
 
-	// Client changed its mind... Note, in this case Data method error is discarded and not returned to the cilent.
-	io.WriteString(c, "RSET\r\n")
+	io.WriteString(c, "NOOP\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	if scanner.Text() != "250 I have sucessfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
+}
 
-	if err := <-be.dataErrors; err != smtp.ErrDataReset {
-		t.Fatal("Backend received a different error:", err)
+func TestServer_EnhancedStatusCodesDisabled(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableEnhancedStatusCodes = false
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if caps["ENHANCEDSTATUSCODES"] {
+		t.Fatal("ENHANCEDSTATUSCODES capability advertised but not enabled")
+	}
+
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 I have sucessfully done nothing" {
+		t.Fatal("Invalid NOOP response:", scanner.Text())
 	}
 }
 
-func TestServer_Chunking_ClosedInTheMiddle(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_REQUIRETLS(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.EnableREQUIRETLS = true
+	})
 	defer s.Close()
 	defer c.Close()
-	be.dataErrors = make(chan error, 10)
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	if caps["REQUIRETLS"] {
+		t.Fatal("REQUIRETLS capability advertised over cleartext")
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
+	if !strings.HasPrefix(scanner.Text(), "530 ") {
 		t.Fatal("Invalid MAIL response:", scanner.Text())
 	}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	tc, scanner, caps := testServerStartTLS(t, c, scanner)
+	if !caps["REQUIRETLS"] {
+		t.Fatal("Missing capability: REQUIRETLS")
+	}
+
+	io.WriteString(tc, "MAIL FROM:<root@nsa.gov> REQUIRETLS\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(tc, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(tc, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(tc, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <")
-
-	// Bye!
-	c.Close()
-
-	if err := <-be.dataErrors; err != smtp.ErrDataReset {
-		t.Fatal("Backend received a different error:", err)
+	if len(be.anonmsgs) != 1 || !be.anonmsgs[0].Opts.RequireTLS {
+		t.Fatal("Expected a message with REQUIRETLS:", be.anonmsgs)
 	}
 }
 
-func TestServer_Chunking_EarlyError(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_Banner(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.Domain = "mx.example.org"
+		s.Banner = "ESMTP Postfix"
+	})
 	defer s.Close()
 	defer c.Close()
 
-	be.dataErr = &smtp.SMTPError{
-		Code:         555,
-		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
-		Message:      "I failed",
+	scanner.Scan()
+	if scanner.Text() != "220 mx.example.org ESMTP Postfix" {
+		t.Fatal("Invalid greeting:", scanner.Text())
 	}
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	io.WriteString(c, "EHLO localhost\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if scanner.Text() != "250-mx.example.org Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+func TestServer_BannerInvalid(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer l.Close()
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	s := smtp.NewServer(new(backend))
+	s.Domain = "mx.example.org"
+	s.Banner = "ESMTP\r\n250 Injected"
+	if err := s.Serve(l); err == nil {
+		t.Fatal("Expected an error for a banner containing CRLF")
 	}
 }
 
-func TestServer_Chunking_EarlyErrorDuringChunk(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_HELP(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.HelpText = "This is a mail server\nSee RFC 5321\n"
+	})
 	defer s.Close()
 	defer c.Close()
 
-	be.dataErr = &smtp.SMTPError{
-		Code:         555,
-		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
-		Message:      "I failed",
+	io.WriteString(c, "HELP\r\n")
+	for _, want := range []string{
+		"214-This is a mail server",
+		"214 2.0.0 See RFC 5321",
+	} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid HELP response: got %q, want %q", scanner.Text(), want)
+		}
 	}
-	be.dataErrOffset = 5
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	io.WriteString(c, "HELP MAIL\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	if scanner.Text() != "214-This is a mail server" {
+		t.Fatal("Invalid HELP response:", scanner.Text())
 	}
+}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+func TestServer_HelpTextInvalid(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
 	}
+	defer l.Close()
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	s := smtp.NewServer(new(backend))
+	s.HelpText = "Help\r\n250 Injected"
+	if err := s.Serve(l); err == nil {
+		t.Fatal("Expected an error for a help text containing CR")
 	}
+}
 
-	// See that command stream state is not corrupted e.g. server is still not
-	// waiting for remaining chunk octets.
-	io.WriteString(c, "NOOP\r\n")
+func TestServer_ReadTimeout(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.ReadTimeout = 100 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Partial line, then stall
+	io.WriteString(c, "MAIL FROM:")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "421 ") {
+		t.Fatal("Invalid response, expected a timeout but got:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
 	}
 }
 
-func TestServer_Chunking_tooLongMessage(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_ReadTimeoutData(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.ReadTimeout = 200 * time.Millisecond
+	})
 	defer s.Close()
-
-	s.MaxMessageBytes = 50
+	defer c.Close()
 
 	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
 	scanner.Scan()
 	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
 	scanner.Scan()
-	io.WriteString(c, "BDAT 30\r\n")
-	io.WriteString(c, "This is a very long message.\r\n")
+	io.WriteString(c, "DATA\r\n")
 	scanner.Scan()
 
-	io.WriteString(c, "BDAT 96 LAST\r\n")
-	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
-	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	// The whole transfer takes longer than ReadTimeout, but each line is
+	// received in time
+	for i := 0; i < 5; i++ {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(c, "Hey <3\r\n")
+	}
+	io.WriteString(c, ".\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "552 ") {
-		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
 	}
 
-	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
 	}
 }
 
-func TestServer_Chunking_Binarymime(t *testing.T) {
-	be, s, c, scanner := testServerAuthenticated(t)
+func TestServer_VRFY(t *testing.T) {
+	be, s, c, scanner := testServerGreeted(t)
 	defer s.Close()
 	defer c.Close()
-	s.EnableBINARYMIME = true
+	be.lists = map[string][]string{
+		"friends": {"alice@wonderland.book", "hatter@wonderland.book"},
+	}
 
-	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid MAIL response:", scanner.Text())
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
 	}
 
-	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
-	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid RCPT response:", scanner.Text())
+	for _, tc := range []struct {
+		cmd   string
+		reply []string
+	}{
+		{"VRFY <alice@wonderland.book>", []string{"250 2.1.5 <alice@wonderland.book>"}},
+		{"VRFY bob@wonderland.book", []string{"550 5.1.1 No such user"}},
+		{"VRFY alice@wonder\rland.book", []string{"501 5.5.4 Was expecting VRFY arg syntax of <address>"}},
+		{"VRFY", []string{"501 5.5.4 Was expecting VRFY arg syntax of <address>"}},
+		{"EXPN friends", []string{"250-<alice@wonderland.book>", "250 2.1.5 <hatter@wonderland.book>"}},
+		{"EXPN enemies", []string{"550 5.1.1 No such list"}},
+		{"EXPN broken", []string{"451 4.0.0 directory unavailable"}},
+	} {
+		io.WriteString(c, tc.cmd+"\r\n")
+		for _, want := range tc.reply {
+			scanner.Scan()
+			if scanner.Text() != want {
+				t.Errorf("%v: got reply %q, want %q", tc.cmd, scanner.Text(), want)
+			}
+		}
 	}
+}
 
-	io.WriteString(c, "BDAT 8\r\n")
-	io.WriteString(c, "Hey <3\r\n")
+func TestServer_VRFYDefault(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "VRFY <alice@wonderland.book>\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner.Text())
 	}
 
-	io.WriteString(c, "BDAT 8 LAST\r\n")
-	io.WriteString(c, "Hey :3\r\n")
+	io.WriteString(c, "EXPN friends\r\n")
 	scanner.Scan()
-	if !strings.HasPrefix(scanner.Text(), "250 ") {
-		t.Fatal("Invalid BDAT response:", scanner.Text())
+	if !strings.HasPrefix(scanner.Text(), "252 ") {
+		t.Fatal("Invalid EXPN response:", scanner.Text())
 	}
+}
 
-	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
-		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
-	}
+func TestServer_MalformedCommands(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		code string
+	}{
+		{"MAIL", "501"},
+		{"MAIL ", "501"},
+		{"MAIL FROM", "501"},
+		{"MAIL FROM:", "501"},
+		{"MAIL TO:<alice@wonderland.book>", "501"},
+		{"MAIL <alice@wonderland.book>", "501"},
+		{"mail from:<alice@wonderland.book>", "250"},
+		{"MAIL FROM: <alice@wonderland.book>", "250"},
+		{"MAIL FROM:  <alice@wonderland.book>  ", "250"},
+		{"MAIL From:<>", "250"},
+		{"RCPT", "501"},
+		{"RCPT TO", "501"},
+		{"RCPT TO:", "501"},
+		{"RCPT FROM:<bob@wonderland.book>", "501"},
+		{"rcpt to:<bob@wonderland.book>", "250"},
+		{"RCPT TO: <bob@wonderland.book>", "250"},
+		{"AUTH", "501"},
+		{"AUTH ", "501"},
+		{"HELO", "501"},
+		{"EHLO", "501"},
+	} {
+		_, s, c, scanner, _ := testServerEhlo(t)
+
+		if strings.HasPrefix(strings.ToUpper(tc.line), "RCPT") {
+			io.WriteString(c, "MAIL FROM:<alice@wonderland.book>\r\n")
+			scanner.Scan()
+		}
 
-	msg := be.messages[0]
-	if msg.From != "root@nsa.gov" {
-		t.Fatal("Invalid mail sender:", msg.From)
-	}
-	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
-		t.Fatal("Invalid mail recipients:", msg.To)
+		io.WriteString(c, tc.line+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.code+" ") {
+			t.Errorf("%q: got reply %q, want %v", tc.line, scanner.Text(), tc.code)
+		}
+
+		c.Close()
+		s.Close()
 	}
-	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
-		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+}
+
+func TestServer_NewSessionError(t *testing.T) {
+	for _, tc := range []struct {
+		err    error
+		reply  string
+		closed bool
+	}{
+		{
+			err:    &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Go away"},
+			reply:  "554 Go away",
+			closed: true,
+		},
+		{
+			err:    &smtp.SMTPError{Code: 550, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Bad HELO"},
+			reply:  "550 Bad HELO",
+			closed: false,
+		},
+		{
+			err:    errors.New("backend unavailable"),
+			reply:  "451 backend unavailable",
+			closed: false,
+		},
+	} {
+		be, s, c, scanner := testServerGreeted(t)
+		be.sessionErr = tc.err
+
+		io.WriteString(c, "EHLO localhost\r\n")
+		scanner.Scan()
+		if scanner.Text() != tc.reply {
+			t.Errorf("Got EHLO reply %q, want %q", scanner.Text(), tc.reply)
+		}
+
+		io.WriteString(c, "NOOP\r\n")
+		if closed := !scanner.Scan(); closed != tc.closed {
+			t.Errorf("%v: got closed = %v, want %v", tc.err, closed, tc.closed)
+		}
+
+		c.Close()
+		s.Close()
 	}
 }
 
-func TestServer_TooLongCommand(t *testing.T) {
-	_, s, c, scanner := testServerAuthenticated(t)
-	defer s.Close()
-	defer c.Close()
+type greetingBackend struct {
+	*backend
+	err error
+}
 
-	io.WriteString(c, "MAIL FROM:<"+strings.Repeat("a", s.MaxLineLength)+">\r\n")
+func (be *greetingBackend) CheckConnection(c smtp.ConnectionState) error {
+	if c.RemoteAddr == nil {
+		return errors.New("missing remote address")
+	}
+	return be.err
+}
+
+func TestServer_GreetingBackend(t *testing.T) {
+	for _, tc := range []struct {
+		err      error
+		greeting string
+	}{
+		{
+			err:      &smtp.SMTPError{Code: 554, EnhancedCode: smtp.EnhancedCode{5, 7, 1}, Message: "Go away"},
+			greeting: "554 Go away",
+		},
+		{
+			err:      errors.New("blocklisted"),
+			greeting: "554 Connection rejected",
+		},
+	} {
+		_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+			s.Backend = &greetingBackend{s.Backend.(*backend), tc.err}
+		})
+
+		scanner.Scan()
+		if scanner.Text() != tc.greeting {
+			t.Errorf("Invalid greeting: got %q, want %q", scanner.Text(), tc.greeting)
+		}
+		if scanner.Scan() {
+			t.Errorf("Expected the connection to be closed, got %q", scanner.Text())
+		}
+
+		c.Close()
+		s.Close()
+	}
+
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.Backend = &greetingBackend{backend: s.Backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+}
+
+func TestServer_GreetingDelay(t *testing.T) {
+	var delayed net.Addr
+	start := time.Now()
+	_, s, c, _ := testServerGreeted(t, func(s *smtp.Server) {
+		s.GreetingDelayFunc = func(remoteAddr net.Addr) time.Duration {
+			delayed = remoteAddr
+			return 200 * time.Millisecond
+		}
+		s.RejectEarlyTalkers = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Greeting sent after %v", d)
+	}
+	if delayed == nil || delayed.String() != c.LocalAddr().String() {
+		t.Errorf("GreetingDelayFunc called with %v, want %v", delayed, c.LocalAddr())
+	}
+}
+
+func TestServer_RejectEarlyTalkers(t *testing.T) {
+	_, s, c, scanner := testServer(t, func(s *smtp.Server) {
+		s.GreetingDelay = 5 * time.Second
+		s.RejectEarlyTalkers = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	scanner.Scan()
+	if scanner.Text() != "554 SMTP protocol violation" {
+		t.Fatal("Invalid response:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_IdleTimeout(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.ReadTimeout = 200 * time.Millisecond
+		s.IdleTimeout = 500 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Commands keep the session alive
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid RSET response:", scanner.Text())
+		}
+	}
+
+	// NOOP doesn't, even if each of them is received before ReadTimeout
+	noops := 0
+	for {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(c, "NOOP\r\n")
+		if !scanner.Scan() {
+			t.Fatal("Connection closed without a reply")
+		}
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+		noops++
+		if noops > 20 {
+			t.Fatal("Session wasn't closed")
+		}
+	}
+	if !strings.HasPrefix(scanner.Text(), "421 4.4.2 ") {
+		t.Fatal("Invalid response, expected a timeout but got:", scanner.Text())
+	}
+	if noops == 0 {
+		t.Error("Session closed before the first NOOP")
+	}
+}
+
+func TestServer_IdleTimeoutSlowData(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.IdleTimeout = 300 * time.Millisecond
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "354 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// The transfer lasts longer than IdleTimeout, but isn't idle
+	for i := 0; i < 6; i++ {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(c, "Still typing\r\n")
+	}
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	// The body counts as activity: the session isn't closed right away
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+
+	// Same for a slow BDAT chunk
+	io.WriteString(c, "BDAT 48 LAST\r\n")
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		io.WriteString(c, "Still typing\r\n")
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.anonmsgs) != 2 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+}
+
+func TestServer_MaxRecipients(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.MaxRecipients = 2
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for i := 0; i < 2; i++ {
+		io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "RCPT TO:<root@bnd.bund.de>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid RCPT response:", scanner.Text())
+		}
+		io.WriteString(c, "RCPT TO:<root@dgse.gouv.fr>\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "452 ") {
+			t.Fatal("Invalid RCPT response, expected an error but got:", scanner.Text())
+		}
+
+		// The count is reset by RSET and by a completed transaction
+		if i == 0 {
+			io.WriteString(c, "RSET\r\n")
+			scanner.Scan()
+			continue
+		}
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, "Hey <3\r\n.\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatal("Invalid DATA response:", scanner.Text())
+		}
+	}
+
+	if len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.anonmsgs)
+	}
+	msg := be.anonmsgs[0]
+	if len(msg.To) != 2 {
+		t.Fatal("Invalid recipients:", msg.To)
+	}
+	for i, opts := range msg.RcptOpts {
+		if opts.Count != i {
+			t.Errorf("Invalid recipient count for #%v: %v", i, opts.Count)
+		}
+	}
+}
+
+func TestServer_requireTLS(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+		s.AllowInsecureAuth = false
+		s.RequireTLSForMail = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for cap := range caps {
+		if strings.HasPrefix(cap, "AUTH") {
+			t.Fatal("AUTH capability advertised over cleartext")
+		}
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "538 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "530 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	tc, scanner, caps := testServerStartTLS(t, c, scanner)
+	if !caps["AUTH PLAIN LOGIN"] {
+		t.Fatal("Missing capability: AUTH")
+	}
+
+	io.WriteString(tc, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(tc, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_TLSConnectionState(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if be.state.TLS.HandshakeComplete {
+		t.Error("Backend got a TLS connection state before STARTTLS")
+	}
+
+	io.WriteString(c, "STARTTLS\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tc := tls.Client(c, &tls.Config{
+		ServerName:         "mx.example.org",
+		InsecureSkipVerify: true,
+	})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal("TLS handshake failed:", err)
+	}
+	scanner = bufio.NewScanner(tc)
+
+	io.WriteString(tc, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	state := be.state.TLS
+	if !state.HandshakeComplete {
+		t.Fatal("Backend didn't get the TLS connection state")
+	}
+	if state.ServerName != "mx.example.org" {
+		t.Errorf("Got SNI server name %q, want %q", state.ServerName, "mx.example.org")
+	}
+	if want := tc.ConnectionState().CipherSuite; state.CipherSuite != want {
+		t.Errorf("Got cipher suite %v, want %v", state.CipherSuite, want)
+	}
+}
+
+func TestServer_TLSConfigForHost(t *testing.T) {
+	defaultConfig := testTLSConfig(t)
+	hostConfigs := map[string]*tls.Config{
+		"mx.example.org": testTLSConfig(t),
+		"mx.example.com": testTLSConfig(t),
+	}
+
+	for _, tc := range []struct {
+		serverName string
+		config     *tls.Config
+	}{
+		{"mx.example.org", hostConfigs["mx.example.org"]},
+		{"MX.example.com", hostConfigs["mx.example.com"]},
+		{"mx.example.net", defaultConfig},
+		{"", defaultConfig},
+	} {
+		_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+			s.TLSConfig = defaultConfig
+			s.TLSConfigForHost = hostConfigs
+		})
+
+		io.WriteString(c, "STARTTLS\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "220 ") {
+			t.Fatal("Invalid STARTTLS response:", scanner.Text())
+		}
+
+		tlsConn := tls.Client(c, &tls.Config{
+			ServerName:         tc.serverName,
+			InsecureSkipVerify: true,
+		})
+		if err := tlsConn.Handshake(); err != nil {
+			t.Fatal("TLS handshake failed:", err)
+		}
+
+		got := tlsConn.ConnectionState().PeerCertificates[0].Raw
+		want := tc.config.Certificates[0].Certificate[0]
+		if !bytes.Equal(got, want) {
+			t.Errorf("SNI %q: server didn't present the expected certificate", tc.serverName)
+		}
+
+		// Let the server complete the handshake before closing
+		io.WriteString(tlsConn, "QUIT\r\n")
+		bufio.NewScanner(tlsConn).Scan()
+
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestServer_STARTTLSInjection(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.TLSConfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	// Commands pipelined after STARTTLS are sent in cleartext and must be
+	// ignored
+	io.WriteString(c, "STARTTLS\r\nMAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "220 ") {
+		t.Fatal("Invalid STARTTLS response:", scanner.Text())
+	}
+
+	tc := tls.Client(c, &tls.Config{InsecureSkipVerify: true})
+	if err := tc.Handshake(); err != nil {
+		t.Fatal("TLS handshake failed:", err)
+	}
+	scanner = bufio.NewScanner(tc)
+
+	io.WriteString(tc, "RCPT TO:<bob@wonderland.book>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "502 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongLine(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+strings.Repeat("A", 2000))
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response, expected an error but got:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongCommandLine(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> "+strings.Repeat("A", 10*1024)+"\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid response, expected an error but got:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+}
+
+func TestServer_tooLongDataLine(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, strings.Repeat("A", 10*1024)+"\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+	if scanner.Scan() {
+		t.Fatal("Expected the connection to be closed, got:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+}
+
+func TestServer_anonymousUserError(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.userErr = smtp.ErrAuthRequired
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "502 5.7.0 Please authenticate first" {
+		t.Fatal("Backend refused anonymous mail but client was permitted:", scanner.Text())
+	}
+}
+
+func TestServer_anonymousUserOK(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_authParam(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t)
+	defer s.Close()
+	defer c.Close()
+
+	// Invalid HEXCHAR
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+A>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// Invalid HEXCHAR
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<he+YYa>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "500 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// https://tools.ietf.org/html/rfc4954#section-4
+	// >servers that advertise support for this
+	// >extension MUST support the AUTH parameter to the MAIL FROM
+	// >command even when the client has not authenticated itself to the
+	// >server.
+	io.WriteString(c, "MAIL FROM: root@nsa.gov AUTH=<hey+3Da>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	// Go on as usual.
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n")
+	io.WriteString(c, ".\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+	if val := be.anonmsgs[0].Opts.Auth; val == nil || *val != "hey=a" {
+		t.Fatal("Invalid Auth value:", val)
+	}
+}
+
+func testStrictServer(t *testing.T) (s *smtp.Server, c net.Conn, scanner *bufio.Scanner) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s = smtp.NewServer(new(backend))
+	s.Domain = "localhost"
+	s.AllowInsecureAuth = true
+	s.AuthDisabled = true
+	s.Strict = true
+
+	go s.Serve(l)
+
+	c, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner = bufio.NewScanner(c)
+
+	scanner.Scan()
+	if scanner.Text() != "220 localhost ESMTP Service Ready" {
+		t.Fatal("Invalid greeting:", scanner.Text())
+	}
+
+	io.WriteString(c, "EHLO localhost\r\n")
+
+	scanner.Scan()
+	if scanner.Text() != "250-localhost Hello localhost" {
+		t.Fatal("Invalid EHLO response:", scanner.Text())
+	}
+
+	expectedCaps := []string{"PIPELINING", "8BITMIME"}
+	caps := make(map[string]bool)
+
+	for scanner.Scan() {
+		s := scanner.Text()
+
+		if strings.HasPrefix(s, "250 ") {
+			caps[strings.TrimPrefix(s, "250 ")] = true
+			break
+		} else {
+			if !strings.HasPrefix(s, "250-") {
+				t.Fatal("Invalid capability response:", s)
+			}
+			caps[strings.TrimPrefix(s, "250-")] = true
+		}
+	}
+
+	for _, cap := range expectedCaps {
+		if !caps[cap] {
+			t.Fatal("Missing capability:", cap)
+		}
+	}
+
+	return
+}
+
+func TestStrictServerGood(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestStrictServerBad(t *testing.T) {
+	s, c, scanner := testStrictServer(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM: root@nsa.gov\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}
+
+func TestServer_Chunking_pipelined(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	s.EnableBINARYMIME = true
+
+	// Binary data, including a dot at the start of a line and a bare LF
+	chunk := "Hey <3\r\n.\r\n\x00\n"
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n"+
+		"RCPT TO:<root@gchq.gov.uk>\r\n"+
+		"BDAT "+strconv.Itoa(len(chunk))+"\r\n"+chunk+
+		"BDAT 0 LAST\r\n")
+
+	for i := 0; i < 4; i++ {
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			t.Fatalf("Invalid response #%v: %v", i, scanner.Text())
+		}
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if string(be.messages[0].Data) != chunk {
+		t.Fatalf("Invalid mail data: %q", be.messages[0].Data)
+	}
+}
+
+func TestServer_Chunking_reset(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8\r\nHey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RSET response:", scanner.Text())
+	}
+
+	// The aborted message must not be mixed with the next one
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8 LAST\r\nHey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if want := "Hey :3\r\n"; string(be.messages[0].Data) != want {
+		t.Fatalf("Invalid mail data: %q", be.messages[0].Data)
+	}
+}
+
+func TestServer_Chunking_LMTP(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	s.LMTP = true
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+	io.WriteString(c, "RCPT TO:<toor@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}
+
+func TestServer_Chunking_Reset(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	// Client changed its mind... Note, in this case Data method error is discarded and not returned to the cilent.
+	io.WriteString(c, "RSET\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if err := <-be.dataErrors; err != smtp.ErrDataReset {
+		t.Fatal("Backend received a different error:", err)
+	}
+}
+
+func TestServer_Chunking_ClosedInTheMiddle(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	be.dataErrors = make(chan error, 10)
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <")
+
+	// Bye!
+	c.Close()
+
+	if err := <-be.dataErrors; err != smtp.ErrDataReset {
+		t.Fatal("Backend received a different error:", err)
+	}
+}
+
+func TestServer_Chunking_EarlyError(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.dataErr = &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "I failed",
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking_EarlyErrorDuringChunk(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	be.dataErr = &smtp.SMTPError{
+		Code:         555,
+		EnhancedCode: smtp.EnhancedCode{5, 0, 0},
+		Message:      "I failed",
+	}
+	be.dataErrOffset = 5
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "555 5.0.0 I failed") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	// See that command stream state is not corrupted e.g. server is still not
+	// waiting for remaining chunk octets.
+	io.WriteString(c, "NOOP\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+}
+
+func TestServer_Chunking_tooLongMessage(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+
+	s.MaxMessageBytes = 50
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 30\r\n")
+	io.WriteString(c, "This is a very long message.\r\n")
+	scanner.Scan()
+
+	io.WriteString(c, "BDAT 96 LAST\r\n")
+	io.WriteString(c, "Much longer than you can possibly imagine.\r\n")
+	io.WriteString(c, "And much longer than the server's MaxMessageBytes.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", scanner.Text())
+	}
+
+	if len(be.messages) != 0 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+}
+
+func TestServer_BINARYMIMECapability(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableBINARYMIME = true
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, name := range []string{"CHUNKING", "BINARYMIME"} {
+		if _, ok := caps[name]; !ok {
+			t.Errorf("%v capability is missing", name)
+		}
+	}
+
+	s.EnableBINARYMIME = false
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "504 ") {
+		t.Fatal("Invalid MAIL response, expected an error but got:", scanner.Text())
+	}
+}
+
+func TestServer_BINARYMIMEWithoutChunking(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// Servers which aren't created with NewServer don't advertise CHUNKING
+	s := &smtp.Server{Backend: new(backend), EnableBINARYMIME: true}
+	if err := s.Serve(l); err == nil {
+		t.Fatal("Expected an error for BINARYMIME without CHUNKING")
+	}
+}
+
+func TestServer_Chunking_Binarymime(t *testing.T) {
+	be, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+	s.EnableBINARYMIME = true
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov> BODY=BINARYMIME\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8\r\n")
+	io.WriteString(c, "Hey <3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "BDAT 8 LAST\r\n")
+	io.WriteString(c, "Hey :3\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+
+	if len(be.messages) != 1 || len(be.anonmsgs) != 0 {
+		t.Fatal("Invalid number of sent messages:", be.messages, be.anonmsgs)
+	}
+
+	msg := be.messages[0]
+	if msg.From != "root@nsa.gov" {
+		t.Fatal("Invalid mail sender:", msg.From)
+	}
+	if len(msg.To) != 1 || msg.To[0] != "root@gchq.gov.uk" {
+		t.Fatal("Invalid mail recipients:", msg.To)
+	}
+	if want := "Hey <3\r\nHey :3\r\n"; string(msg.Data) != want {
+		t.Fatal("Invalid mail data:", string(msg.Data), msg.Data)
+	}
+}
+
+func TestServer_TooLongCommand(t *testing.T) {
+	_, s, c, scanner := testServerAuthenticated(t)
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<"+strings.Repeat("a", s.MaxLineLength)+">\r\n")
 	scanner.Scan()
 	if !strings.HasPrefix(scanner.Text(), "500 5.4.0 ") {
 		t.Fatal("Invalid too long MAIL response:", scanner.Text())
 	}
 }
+
+func TestServer_LogoutReason(t *testing.T) {
+	be, _, c, scanner := testServerGreeted(t)
+	defer c.Close()
+	be.logoutReasons = make(chan error, 1)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	io.WriteString(c, "QUIT\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "221 ") {
+		t.Fatal("Invalid QUIT response:", scanner.Text())
+	}
+
+	select {
+	case err := <-be.logoutReasons:
+		if err != nil {
+			t.Fatal("Expected nil logout reason after QUIT, got:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session wasn't logged out")
+	}
+}
+
+func TestServer_LogoutReasonDrop(t *testing.T) {
+	be, _, c, scanner := testServerGreeted(t)
+	be.logoutReasons = make(chan error, 1)
+
+	io.WriteString(c, "EHLO localhost\r\n")
+	for scanner.Scan() {
+		if strings.HasPrefix(scanner.Text(), "250 ") {
+			break
+		}
+	}
+
+	c.Close()
+
+	select {
+	case err := <-be.logoutReasons:
+		if err != io.EOF {
+			t.Fatal("Expected io.EOF logout reason after client drop, got:", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Session wasn't logged out")
+	}
+}
+
+// connBackend passes the connection to receivedSession.
+type connBackend struct {
+	*backend
+	headers chan string
+}
+
+func (be *connBackend) NewConnSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.backend.NewSession(c.State(), c.State().Hostname)
+	if err != nil {
+		return nil, err
+	}
+	return &receivedSession{Session: sess, conn: c, headers: be.headers}, nil
+}
+
+// receivedSession sends the Received header of each message.
+type receivedSession struct {
+	smtp.Session
+	conn    *smtp.Conn
+	headers chan string
+}
+
+func (s *receivedSession) Data(r io.Reader) error {
+	s.headers <- s.conn.ReceivedHeader()
+	return s.Session.Data(r)
+}
+
+func testReceivedHeader(t *testing.T, c io.Writer, scanner *bufio.Scanner, headers chan string) string {
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	select {
+	case h := <-headers:
+		return h
+	case <-time.After(5 * time.Second):
+		t.Fatal("Data wasn't called")
+		return ""
+	}
+}
+
+func TestServer_ReceivedHeader(t *testing.T) {
+	headers := make(chan string, 1)
+	_, s, c, scanner := testServerGreeted(t, func(s *smtp.Server) {
+		s.Backend = &connBackend{s.Backend.(*backend), headers}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "HELO example.org\r\n")
+	scanner.Scan()
+
+	h := testReceivedHeader(t, c, scanner, headers)
+	prefix := "Received: from example.org ([127.0.0.1])\r\n\tby localhost with SMTP\r\n\tid "
+	if !strings.HasPrefix(h, prefix) {
+		t.Fatalf("Invalid Received header: %q", h)
+	}
+	if !strings.Contains(h, "\r\n\tfor <root@gchq.gov.uk>;\r\n\t") || !strings.HasSuffix(h, "\r\n") {
+		t.Fatalf("Invalid Received header: %q", h)
+	}
+	date := strings.TrimSuffix(h[strings.LastIndex(h, "\t")+1:], "\r\n")
+	if _, err := time.Parse(time.RFC1123Z, date); err != nil {
+		t.Fatalf("Invalid Received header date: %v", err)
+	}
+}
+
+func TestServer_ReceivedHeaderTLS(t *testing.T) {
+	headers := make(chan string, 1)
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend = &connBackend{s.Backend.(*backend), headers}
+		s.TLSConfig = testTLSConfig(t)
+	})
+	defer s.Close()
+	defer c.Close()
+
+	tc, scanner, _ := testServerStartTLS(t, c, scanner)
+
+	io.WriteString(tc, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	h := testReceivedHeader(t, tc, scanner, headers)
+	prefix := "Received: from localhost ([127.0.0.1])\r\n\tby localhost with ESMTPSA (TLS1.3 cipher=TLS_"
+	if !strings.HasPrefix(h, prefix) {
+		t.Fatalf("Invalid Received header: %q", h)
+	}
+}
+
+// authBackend passes the connection to authSession.
+type authBackend struct {
+	*backend
+}
+
+func (be *authBackend) NewConnSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.backend.NewSession(c.State(), c.State().Hostname)
+	if err != nil {
+		return nil, err
+	}
+	return &authSession{Session: sess, conn: c}, nil
+}
+
+// authSession only accepts mail from the authenticated user.
+type authSession struct {
+	smtp.Session
+	conn *smtp.Conn
+}
+
+func (s *authSession) Mail(from string, opts *smtp.MailOptions) error {
+	if user, ok := s.conn.AuthenticatedUser(); !ok || from != user+"@example.org" {
+		return &smtp.SMTPError{
+			Code:         553,
+			EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+			Message:      "Sender not owned by the authenticated user",
+		}
+	}
+	return s.Session.Mail(from, opts)
+}
+
+func TestServer_AuthenticatedUser(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend = &authBackend{s.Backend.(*backend)}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<username@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "553 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHdyb25n\r\n")
+	scanner.Scan()
+	if strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+	io.WriteString(c, "MAIL FROM:<username@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "553 ") {
+		t.Fatal("Invalid MAIL response after failed AUTH:", scanner.Text())
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "553 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+	io.WriteString(c, "MAIL FROM:<username@example.org>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+}
+
+func TestServer_QueueID(t *testing.T) {
+	be, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.EnableBINARYMIME = true
+	})
+	defer s.Close()
+	defer c.Close()
+	be.queueID = "4C9F1A2B3"
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "DATA\r\n")
+	scanner.Scan()
+	io.WriteString(c, "Hey <3\r\n.\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 OK: queued as 4C9F1A2B3" {
+		t.Fatal("Invalid DATA response:", scanner.Text())
+	}
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	io.WriteString(c, "BDAT 8 LAST\r\nHey <3\r\n")
+	scanner.Scan()
+	if scanner.Text() != "250 2.0.0 OK: queued as 4C9F1A2B3" {
+		t.Fatal("Invalid BDAT response:", scanner.Text())
+	}
+}
+
+func TestServerAuthUTF8(t *testing.T) {
+	const (
+		username = "usér名"
+		password = "pässwörd\u2603"
+	)
+	b64 := base64.StdEncoding.EncodeToString
+
+	tests := []struct {
+		name  string
+		lines []string // client lines, each followed by a reply
+		want  []string // reply prefixes
+	}{
+		{
+			name:  "PLAIN initial response",
+			lines: []string{"AUTH PLAIN " + b64([]byte("\x00"+username+"\x00"+password))},
+			want:  []string{"235 "},
+		},
+		{
+			name:  "PLAIN initial response with authzid",
+			lines: []string{"AUTH PLAIN " + b64([]byte(username+"\x00"+username+"\x00"+password))},
+			want:  []string{"235 "},
+		},
+		{
+			name:  "PLAIN continuation",
+			lines: []string{"AUTH PLAIN", b64([]byte("\x00" + username + "\x00" + password))},
+			want:  []string{"334 ", "235 "},
+		},
+		{
+			name:  "LOGIN",
+			lines: []string{"AUTH LOGIN", b64([]byte(username)), b64([]byte(password))},
+			want:  []string{"334 VXNlcm5hbWU6", "334 UGFzc3dvcmQ6", "235 "},
+		},
+		{
+			name:  "LOGIN initial response",
+			lines: []string{"AUTH LOGIN " + b64([]byte(username)), b64([]byte(password))},
+			want:  []string{"334 UGFzc3dvcmQ6", "235 "},
+		},
+		{
+			name:  "LOGIN empty username",
+			lines: []string{"AUTH LOGIN =", b64([]byte("empty"))},
+			want:  []string{"334 UGFzc3dvcmQ6", "235 "},
+		},
+		{
+			name:  "wrong password",
+			lines: []string{"AUTH PLAIN " + b64([]byte("\x00"+username+"\x00password"))},
+			want:  []string{"454 "},
+		},
+		{
+			name:  "invalid base64 initial response",
+			lines: []string{"AUTH PLAIN !!!"},
+			want:  []string{"501 "},
+		},
+		{
+			name:  "invalid base64 continuation",
+			lines: []string{"AUTH PLAIN", "!!!"},
+			want:  []string{"334 ", "501 "},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			be, s, c, scanner, _ := testServerEhlo(t)
+			defer s.Close()
+			defer c.Close()
+			be.users = map[string]string{username: password, "": "empty"}
+
+			for i, l := range tc.lines {
+				io.WriteString(c, l+"\r\n")
+				scanner.Scan()
+				if !strings.HasPrefix(scanner.Text(), tc.want[i]) {
+					t.Fatalf("Invalid response to %q: %v", l, scanner.Text())
+				}
+			}
+		})
+	}
+}
+
+type sizeBackend struct {
+	*backend
+}
+
+func (be *sizeBackend) NewConnSession(c *smtp.Conn) (smtp.Session, error) {
+	sess, err := be.backend.NewSession(c.State(), c.State().Hostname)
+	if err != nil {
+		return nil, err
+	}
+	return &sizeSession{Session: sess, conn: c}, nil
+}
+
+// sizeSession accepts larger messages from authenticated users.
+type sizeSession struct {
+	smtp.Session
+	conn *smtp.Conn
+}
+
+func (s *sizeSession) MaxMessageBytes() int {
+	if _, ok := s.conn.AuthenticatedUser(); ok {
+		return 200
+	}
+	return 50
+}
+
+func TestServer_MessageSizeSession(t *testing.T) {
+	be, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.Backend = &sizeBackend{s.Backend.(*backend)}
+		s.MaxMessageBytes = 100
+	})
+	defer s.Close()
+	defer c.Close()
+
+	if _, ok := caps["SIZE 100"]; !ok {
+		t.Fatal("Expected the global SIZE to be advertised:", caps)
+	}
+
+	msg := strings.Repeat("A message of 150 bytes.\r\n", 6)
+
+	send := func(size int) string {
+		io.WriteString(c, fmt.Sprintf("MAIL FROM:<root@nsa.gov> SIZE=%v\r\n", size))
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "250 ") {
+			return scanner.Text()
+		}
+		io.WriteString(c, "RCPT TO:<root@gchq.gov.uk>\r\n")
+		scanner.Scan()
+		io.WriteString(c, "DATA\r\n")
+		scanner.Scan()
+		io.WriteString(c, msg+".\r\n")
+		scanner.Scan()
+		return scanner.Text()
+	}
+
+	// The stricter limit of anonymous sessions is enforced
+	if reply := send(80); !strings.HasPrefix(reply, "552 ") {
+		t.Fatal("Invalid MAIL response, expected an error but got:", reply)
+	}
+	if reply := send(40); !strings.HasPrefix(reply, "552 ") {
+		t.Fatal("Invalid DATA response, expected an error but got:", reply)
+	}
+
+	io.WriteString(c, "AUTH PLAIN AHVzZXJuYW1lAHBhc3N3b3Jk\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "235 ") {
+		t.Fatal("Invalid AUTH response:", scanner.Text())
+	}
+
+	// The looser limit of authenticated sessions is enforced
+	if reply := send(len(msg)); !strings.HasPrefix(reply, "250 ") {
+		t.Fatal("Invalid DATA response:", reply)
+	}
+	if len(be.messages) != 1 {
+		t.Fatal("Invalid number of sent messages:", be.messages)
+	}
+	if reply := send(250); !strings.HasPrefix(reply, "552 ") {
+		t.Fatal("Invalid MAIL response, expected an error but got:", reply)
+	}
+}
+
+// fakeResolver resolves the domains in mx and hosts, and counts lookups.
+type fakeResolver struct {
+	mx      map[string][]*net.MX
+	hosts   map[string][]string
+	lookups int
+}
+
+func (r *fakeResolver) LookupMX(ctx context.Context, name string) ([]*net.MX, error) {
+	r.lookups++
+	if mx, ok := r.mx[name]; ok {
+		return mx, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+func (r *fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if addrs, ok := r.hosts[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestServer_RequireValidSenderDomain(t *testing.T) {
+	resolver := &fakeResolver{
+		mx:    map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+		hosts: map[string][]string{"example.com": {"192.0.2.1"}},
+	}
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.RequireValidSenderDomain = true
+		s.Resolver = resolver
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, tc := range []struct {
+		from  string
+		reply string
+	}{
+		{"root@example.org", "250 "},
+		{"root@example.com", "250 "},
+		{"", "250 "},
+		{"root@[192.0.2.1]", "250 "},
+		{"root@example.invalid", "450 4.1.8 "},
+	} {
+		io.WriteString(c, "MAIL FROM:<"+tc.from+">\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), tc.reply) {
+			t.Errorf("MAIL FROM:<%v>: got %q, want %q", tc.from, scanner.Text(), tc.reply)
+		}
+		io.WriteString(c, "RSET\r\n")
+		scanner.Scan()
+	}
+}
+
+func TestCachingResolver(t *testing.T) {
+	fake := &fakeResolver{
+		mx: map[string][]*net.MX{"example.org": {{Host: "mx.example.org.", Pref: 10}}},
+	}
+	r := smtp.NewCachingResolver(fake, time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if mx, err := r.LookupMX(context.Background(), "example.org"); err != nil || len(mx) != 1 {
+			t.Fatalf("LookupMX() = %v, %v", mx, err)
+		}
+		var dnsErr *net.DNSError
+		if _, err := r.LookupHost(context.Background(), "example.invalid"); !errors.As(err, &dnsErr) || !dnsErr.IsNotFound {
+			t.Fatalf("LookupHost(): got error %v, want not found", err)
+		}
+	}
+	if fake.lookups != 2 {
+		t.Errorf("Got %v lookups, want 2", fake.lookups)
+	}
+}
+
+func TestServer_ReplyInterceptor(t *testing.T) {
+	_, s, c, scanner, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.HelpText = "This is a mail server"
+		s.ReplyInterceptor = func(cmd string, code int, msg string) (int, string) {
+			switch {
+			case cmd == "RCPT" && code/100 == 5:
+				return 450, msg + " (grace period)"
+			case cmd == "HELP":
+				return code, msg + "\nSee https://example.org"
+			case cmd == "NOOP":
+				return 550, "Not so fast"
+			case cmd == "RSET":
+				return 999, "Invalid"
+			case cmd == "VRFY":
+				return code, "Injected\r\n250 OK"
+			}
+			return code, msg
+		}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	io.WriteString(c, "MAIL FROM:<root@nsa.gov>\r\n")
+	scanner.Scan()
+	if !strings.HasPrefix(scanner.Text(), "250 ") {
+		t.Fatal("Invalid MAIL response:", scanner.Text())
+	}
+
+	io.WriteString(c, "RCPT FROM:<root@gchq.gov.uk>\r\n")
+	scanner.Scan()
+	if scanner.Text() != "450 4.5.2 Was expecting RCPT arg syntax of TO:<address> (grace period)" {
+		t.Fatal("Invalid RCPT response:", scanner.Text())
+	}
+
+	io.WriteString(c, "HELP\r\n")
+	for _, want := range []string{"214-This is a mail server", "214 2.0.0 See https://example.org"} {
+		scanner.Scan()
+		if scanner.Text() != want {
+			t.Fatalf("Invalid HELP response: got %q, want %q", scanner.Text(), want)
+		}
+	}
+
+	// Invalid replies are ignored
+	for _, cmd := range []string{"NOOP", "RSET", "VRFY root@nsa.gov"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "25") || strings.Contains(scanner.Text(), "Injected") {
+			t.Fatalf("Invalid %v response: %q", cmd, scanner.Text())
+		}
+	}
+}
+
+func TestServer_DisabledCommands(t *testing.T) {
+	_, s, c, scanner, caps := testServerEhlo(t, func(s *smtp.Server) {
+		s.DisabledCommands = []string{"vrfy", "AUTH", "BDAT", "ETRN"}
+	})
+	defer s.Close()
+	defer c.Close()
+
+	for _, name := range []string{"AUTH PLAIN LOGIN", "CHUNKING"} {
+		if _, ok := caps[name]; ok {
+			t.Errorf("Disabled extension %v is advertised", name)
+		}
+	}
+	if _, ok := caps["PIPELINING"]; !ok {
+		t.Error("PIPELINING capability is missing")
+	}
+
+	for _, cmd := range []string{"VRFY root@nsa.gov", "AUTH PLAIN", "BDAT 0 LAST", "ETRN example.org"} {
+		io.WriteString(c, cmd+"\r\n")
+		scanner.Scan()
+		if !strings.HasPrefix(scanner.Text(), "502 5.5.1 ") {
+			t.Errorf("Invalid %v response, expected the command to be disabled but got: %v", cmd, scanner.Text())
+		}
+	}
+
+	// VRFY works on a server which doesn't disable it
+	_, s2, c2, scanner2, _ := testServerEhlo(t, func(s *smtp.Server) {
+		s.DisabledCommands = []string{"EXPN"}
+	})
+	defer s2.Close()
+	defer c2.Close()
+
+	io.WriteString(c2, "VRFY root@nsa.gov\r\n")
+	scanner2.Scan()
+	if !strings.HasPrefix(scanner2.Text(), "252 ") {
+		t.Fatal("Invalid VRFY response:", scanner2.Text())
+	}
+}
+
+func TestServer_DisabledCommandsInvalid(t *testing.T) {
+	for _, name := range []string{"MAIL", "FOO"} {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s := smtp.NewServer(new(backend))
+		s.DisabledCommands = []string{name}
+		if err := s.Serve(l); err == nil {
+			t.Errorf("Expected an error for disabling %v", name)
+		}
+		l.Close()
+	}
+}
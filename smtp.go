@@ -10,6 +10,7 @@
 //  REQUIRETLS: RFC 8689
 //  CHUNKING: RFC 3030
 //  BINARYMIME: RFC 3030
+//  DSN: RFC 3461
 //
 // LMTP (RFC 2033) is also supported.
 //
@@ -28,3 +29,13 @@ func validateLine(line string) error {
 	}
 	return nil
 }
+
+// ValidateAddress checks that addr can safely be used as a MAIL FROM or RCPT
+// TO address, without sending anything over the network. It applies the same
+// rules as the client and server: an address must not contain CR or LF, which
+// could be used to inject SMTP commands.
+//
+// This is useful to sanitize a list of recipients before sending a message.
+func ValidateAddress(addr string) error {
+	return validateLine(addr)
+}